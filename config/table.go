@@ -0,0 +1,306 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a typed view over a table decoded from interchange.toml. Viper lowercases every key so lookups are
+// case insensitive. The first invalid value encountered is recorded and can be retrieved with Err,
+// which lets callers read many values before checking for mistakes once
+type Table struct {
+	values map[string]any
+	path   string
+	err    *error
+}
+
+// creates a new Table from the raw map returned by viper
+func NewTable(values map[string]any) *Table {
+	if values == nil {
+		values = map[string]any{}
+	}
+	var err error
+	return &Table{values: values, err: &err}
+}
+
+// returns the first error encountered while reading values from this table or any of its subtables
+func (t *Table) Err() error {
+	return *t.err
+}
+
+// records an error against the given key unless an earlier error has already been recorded
+func (t *Table) Fail(key string, format string, args ...any) {
+	if *t.err == nil {
+		*t.err = fmt.Errorf("%s %s", t.key(key), fmt.Sprintf(format, args...))
+	}
+}
+
+// returns the dotted path of a key within the configuration, used in error messages
+func (t *Table) key(key string) string {
+	if t.path == "" {
+		return key
+	}
+	return t.path + "." + key
+}
+
+// returns the raw value stored under key
+func (t *Table) Get(key string) (any, bool) {
+	value, exists := t.values[strings.ToLower(key)]
+	return value, exists
+}
+
+// reports whether key is set in the table
+func (t *Table) Has(key string) bool {
+	_, exists := t.Get(key)
+	return exists
+}
+
+// returns all the keys set in this table
+func (t *Table) Keys() []string {
+	keys := make([]string, 0, len(t.values))
+	for key := range t.values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (t *Table) String(key string, def string) string {
+	value, exists := t.Get(key)
+	if !exists {
+		return def
+	}
+	str, ok := value.(string)
+	if !ok {
+		t.Fail(key, "must be a string")
+		return def
+	}
+	return str
+}
+
+func (t *Table) Bool(key string, def bool) bool {
+	value, exists := t.Get(key)
+	if !exists {
+		return def
+	}
+	b, ok := value.(bool)
+	if !ok {
+		t.Fail(key, "must be a boolean")
+		return def
+	}
+	return b
+}
+
+func (t *Table) Int(key string, def int) int {
+	value, exists := t.Get(key)
+	if !exists {
+		return def
+	}
+	switch v := value.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	}
+	t.Fail(key, "must be an integer")
+	return def
+}
+
+func (t *Table) Float(key string, def float64) float64 {
+	value, exists := t.Get(key)
+	if !exists {
+		return def
+	}
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	t.Fail(key, "must be a number")
+	return def
+}
+
+// reads a duration written as a string such as "500ms" or "1m30s"
+func (t *Table) Duration(key string, def time.Duration) time.Duration {
+	value, exists := t.Get(key)
+	if !exists {
+		return def
+	}
+	str, ok := value.(string)
+	if !ok {
+		t.Fail(key, "must be a duration string such as \"5s\"")
+		return def
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		t.Fail(key, "is not a valid duration: %s", err)
+		return def
+	}
+	return d
+}
+
+// units accepted by Size, from longest suffix to shortest so "MB" isn't read as "B"
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// reads a number of bytes written either as an integer or as a string such as "64MB" or "512KiB"
+func (t *Table) Size(key string, def int64) int64 {
+	value, exists := t.Get(key)
+	if !exists {
+		return def
+	}
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case string:
+		str := strings.TrimSpace(v)
+		multiplier := int64(1)
+		for _, unit := range sizeUnits {
+			if number, found := strings.CutSuffix(str, unit.suffix); found {
+				str, multiplier = strings.TrimSpace(number), unit.bytes
+				break
+			}
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err == nil && n >= 0 {
+			return n * multiplier
+		}
+	}
+	t.Fail(key, "must be a size such as 1048576 or \"64MB\"")
+	return def
+}
+
+// reads a list of strings. A single string is treated as a list containing just that string
+func (t *Table) StringSlice(key string) []string {
+	value, exists := t.Get(key)
+	if !exists {
+		return nil
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		strs := make([]string, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				t.Fail(key, "must be a list of strings")
+				return nil
+			}
+			strs[i] = str
+		}
+		return strs
+	}
+	t.Fail(key, "must be a list of strings")
+	return nil
+}
+
+// reads a list of integers. A single integer is treated as a list containing just that integer
+func (t *Table) Ints(key string) []int {
+	value, exists := t.Get(key)
+	if !exists {
+		return nil
+	}
+
+	var items []any
+	switch v := value.(type) {
+	case int, int64:
+		items = []any{v}
+	case []any:
+		items = v
+	default:
+		t.Fail(key, "must be a list of integers")
+		return nil
+	}
+
+	ints := make([]int, len(items))
+	for i, item := range items {
+		switch n := item.(type) {
+		case int:
+			ints[i] = n
+		case int64:
+			ints[i] = int(n)
+		default:
+			t.Fail(key, "must be a list of integers")
+			return nil
+		}
+	}
+	return ints
+}
+
+// reads a table of string values, such as a set of headers
+func (t *Table) StringMap(key string) map[string]string {
+	sub := t.Table(key)
+	m := make(map[string]string, len(sub.values))
+	for k, value := range sub.values {
+		str, ok := value.(string)
+		if !ok {
+			sub.Fail(k, "must be a string")
+			continue
+		}
+		m[k] = str
+	}
+	return m
+}
+
+// returns the subtable stored under key. A missing subtable is returned as an empty table so that
+// defaults apply to all of its values
+func (t *Table) Table(key string) *Table {
+	sub := &Table{values: map[string]any{}, path: t.key(key), err: t.err}
+	value, exists := t.Get(key)
+	if !exists {
+		return sub
+	}
+	m, ok := value.(map[string]any)
+	if !ok {
+		t.Fail(key, "must be a table")
+		return sub
+	}
+	sub.values = m
+	return sub
+}
+
+// returns the array of tables stored under key
+func (t *Table) Tables(key string) []*Table {
+	value, exists := t.Get(key)
+	if !exists {
+		return nil
+	}
+	var items []any
+	switch v := value.(type) {
+	case []any:
+		items = v
+	case []map[string]any:
+		for _, m := range v {
+			items = append(items, m)
+		}
+	default:
+		t.Fail(key, "must be an array of tables")
+		return nil
+	}
+
+	tables := make([]*Table, 0, len(items))
+	for i, item := range items {
+		m, ok := item.(map[string]any)
+		if !ok {
+			t.Fail(key, "must be an array of tables")
+			return nil
+		}
+		tables = append(tables, &Table{values: m, path: fmt.Sprintf("%s[%d]", t.key(key), i), err: t.err})
+	}
+	return tables
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/middleware"
+)
+
+// returns a stable, opaque identifier for an upstream used as the value of sticky session cookies. It is derived from
+// the upstream's scheme, host, port and path, which are unique within a service
+func upstreamID(u *url.URL) string {
+	sum := sha256.Sum256([]byte(upstreamKey(u)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hashes a string to a position on the hash ring
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// fnv has poor avalanche on short keys that only differ in their last few bytes so finish it with the
+	// splitmix64 mixer to spread the virtual nodes of each upstream evenly around the ring
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// a single virtual node on the hash ring
+type ringNode struct {
+	hash     uint64
+	upstream *Upstream
+}
+
+// maps requests to upstreams using a consistent hash ring so that adding or removing an upstream only
+// remaps the keys that belonged to it
+type consistentHashBalancer struct {
+	ring []ringNode
+
+	// where the key is read from: ip, header, cookie or path
+	on      string
+	key     string
+	segment int
+
+	// used when a request has no key, such as when the configured header is missing
+	fallback roundRobinBalancer
+}
+
+func newConsistentHashBalancer(cfg *config.Table, upstreams []*Upstream) (*consistentHashBalancer, error) {
+	b := &consistentHashBalancer{
+		on:      cfg.String("hashOn", "ip"),
+		key:     cfg.String("hashKey", ""),
+		segment: cfg.Int("hashSegment", 0),
+	}
+	replicas := cfg.Int("hashReplicas", 160)
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	switch b.on {
+	case "ip":
+	case "header", "cookie":
+		if b.key == "" {
+			return nil, fmt.Errorf("hashKey must be set when hashing on a %s", b.on)
+		}
+	case "path":
+		if b.segment < 0 {
+			return nil, fmt.Errorf("hashSegment must not be negative")
+		}
+	default:
+		return nil, fmt.Errorf("invalid hashOn '%s'", b.on)
+	}
+
+	if replicas < 1 {
+		return nil, fmt.Errorf("hashReplicas must be at least 1")
+	}
+
+	// heavier upstreams get more virtual nodes and therefore a larger share of the keys
+	for _, upstream := range upstreams {
+		for i := 0; i < replicas*upstream.Weight; i++ {
+			b.ring = append(b.ring, ringNode{
+				hash:     hashKey(upstream.URL.String() + "#" + strconv.Itoa(i)),
+				upstream: upstream,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+
+	return b, nil
+}
+
+// extracts the value requests are hashed on, returning an empty string if the request doesn't have one
+func (b *consistentHashBalancer) requestKey(r *http.Request) string {
+	switch b.on {
+	case "ip":
+		return middleware.ClientIP(r).String()
+	case "header":
+		return r.Header.Get(b.key)
+	case "cookie":
+		cookie, err := r.Cookie(b.key)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case "path":
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if b.segment >= len(segments) {
+			return ""
+		}
+		return segments[b.segment]
+	}
+	return ""
+}
+
+func (b *consistentHashBalancer) Next(r *http.Request, candidates []*Upstream) *Upstream {
+	key := b.requestKey(r)
+	if key == "" {
+		return b.fallback.Next(r, candidates)
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= h
+	})
+
+	// walk clockwise from the key until we reach an upstream that is allowed to take the request
+	for i := 0; i < len(b.ring); i++ {
+		node := b.ring[(start+i)%len(b.ring)]
+		if slices.Contains(candidates, node.upstream) {
+			return node.upstream
+		}
+	}
+
+	return b.fallback.Next(r, candidates)
+}
+
+// pins clients to an upstream by issuing a cookie naming the upstream that served their first request
+type stickySessions struct {
+	name     string
+	maxAge   time.Duration
+	secure   bool
+	httpOnly bool
+
+	ids map[*Upstream]string
+}
+
+func newStickySessions(cfg *config.Table, upstreams []*Upstream) (*stickySessions, error) {
+	s := &stickySessions{
+		name:     cfg.String("name", "interchange_upstream"),
+		maxAge:   cfg.Duration("maxAge", 0),
+		secure:   cfg.Bool("secure", false),
+		httpOnly: cfg.Bool("httpOnly", true),
+		ids:      make(map[*Upstream]string, len(upstreams)),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, upstream := range upstreams {
+		s.ids[upstream] = upstreamID(upstream.URL)
+	}
+
+	return s, nil
+}
+
+// returns the upstream named by the request's sticky cookie if it is one of the candidates
+func (s *stickySessions) lookup(r *http.Request, candidates []*Upstream) *Upstream {
+	cookie, err := r.Cookie(s.name)
+	if err != nil {
+		return nil
+	}
+
+	for _, upstream := range candidates {
+		if s.ids[upstream] == cookie.Value {
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+// issues a new sticky cookie if the request wasn't already pinned to the upstream that served it
+func (s *stickySessions) issue(in *http.Request, resp *http.Response, upstream *Upstream) {
+	id := s.ids[upstream]
+	if cookie, err := in.Cookie(s.name); err == nil && cookie.Value == id {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.name,
+		Value:    id,
+		Path:     "/",
+		Secure:   s.secure,
+		HttpOnly: s.httpOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s.maxAge > 0 {
+		cookie.MaxAge = int(s.maxAge.Seconds())
+	}
+
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
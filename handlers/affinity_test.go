@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// returns the host each of n user IDs is sent to by a balancer hashing on the X-User header
+func hashedHosts(t *testing.T, upstreams []*Upstream, candidates []*Upstream, n int) []string {
+	t.Helper()
+	b, err := newConsistentHashBalancer(config.NewTable(map[string]any{"hashon": "header", "hashkey": "X-User"}), upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := make([]string, n)
+	for i := range hosts {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", fmt.Sprint("user-", i))
+		hosts[i] = b.Next(r, candidates).URL.Host
+	}
+	return hosts
+}
+
+func TestConsistentHashIsStable(t *testing.T) {
+	upstreams := testUpstreams("a b c")
+	first := hashedHosts(t, upstreams, upstreams, 500)
+
+	// a new ring built from the same targets, such as after a reload, sends every key to the same place
+	upstreams = testUpstreams("a b c")
+	second := hashedHosts(t, upstreams, upstreams, 500)
+
+	used := map[string]int{}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("user-%d went to %s and then %s", i, first[i], second[i])
+		}
+		used[first[i]]++
+	}
+	if len(used) != 3 {
+		t.Errorf("keys were spread over %v, want all three upstreams", used)
+	}
+}
+
+func TestConsistentHashRemovingUpstream(t *testing.T) {
+	all := testUpstreams("a b c d")
+	before := hashedHosts(t, all, all, 500)
+	remaining := testUpstreams("a b c")
+
+	tests := []struct {
+		name  string
+		after []string
+	}{
+		{"removed from the targets", hashedHosts(t, remaining, remaining, 500)},
+		{"unavailable", hashedHosts(t, all, all[:3], 500)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moved := 0
+			for i := range before {
+				switch {
+				case before[i] == "d" && tt.after[i] == "d":
+					t.Fatalf("user-%d is still sent to the removed upstream", i)
+				case before[i] == "d":
+					moved++
+				case before[i] != tt.after[i]:
+					t.Fatalf("user-%d moved from %s to %s although its upstream wasn't removed", i, before[i], tt.after[i])
+				}
+			}
+			if moved == 0 {
+				t.Error("no keys belonged to the removed upstream")
+			}
+		})
+	}
+}
+
+func TestNewConsistentHashBalancerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"unknown key source", map[string]any{"hashon": "body"}},
+		{"header without a name", map[string]any{"hashon": "header"}},
+		{"cookie without a name", map[string]any{"hashon": "cookie"}},
+		{"negative path segment", map[string]any{"hashon": "path", "hashsegment": -1}},
+		{"no replicas", map[string]any{"hashreplicas": 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newConsistentHashBalancer(config.NewTable(tt.cfg), testUpstreams("a")); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	targets := []any{}
+	for _, name := range []string{"a", "b"} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(upstream.Close)
+		targets = append(targets, upstream.URL)
+	}
+	proxy := newTestProxy(t, nil, map[string]any{
+		"targets":      targets,
+		"stickycookie": map[string]any{"name": "pin"},
+	})
+
+	send := func(cookie *http.Cookie) (string, *http.Cookie) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		var issued *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "pin" {
+				issued = c
+			}
+		}
+		return w.Body.String(), issued
+	}
+
+	first, cookie := send(nil)
+	if cookie == nil {
+		t.Fatal("no sticky cookie was issued")
+	}
+	if !cookie.HttpOnly || cookie.Path != "/" {
+		t.Errorf("cookie = %v, want an HttpOnly cookie for the whole site", cookie)
+	}
+
+	// round robin would alternate, so every request landing on the first upstream means the cookie was honoured
+	for range 4 {
+		served, reissued := send(cookie)
+		if served != first {
+			t.Fatalf("pinned request was served by %s, want %s", served, first)
+		}
+		if reissued != nil {
+			t.Error("a cookie was issued to a client that was already pinned")
+		}
+	}
+
+	for _, upstream := range proxy.split.upstreams() {
+		if upstreamID(upstream.URL) == cookie.Value {
+			upstream.healthy.Store(false)
+		}
+	}
+	served, reissued := send(cookie)
+	if served == first {
+		t.Fatalf("request was sent to the unhealthy upstream %s", first)
+	}
+	if reissued == nil || reissued.Value == cookie.Value {
+		t.Errorf("cookie = %v, want one naming the upstream the request fell back to", reissued)
+	}
+}
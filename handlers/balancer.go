@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// selects which of the candidate upstreams should handle a request. candidates is never empty
+type Balancer interface {
+	Next(r *http.Request, candidates []*Upstream) *Upstream
+}
+
+// creates the balancer configured on a service
+func newBalancer(cfg *config.Table, upstreams []*Upstream) (Balancer, error) {
+	strategy := cfg.String("balancer", "roundRobin")
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	switch strategy {
+	case "roundRobin":
+		return &roundRobinBalancer{}, nil
+	case "weightedRoundRobin":
+		return &weightedRoundRobinBalancer{current: map[*Upstream]int{}}, nil
+	case "leastConnections":
+		return &leastConnectionsBalancer{}, nil
+	case "randomTwoChoices":
+		return randomTwoChoicesBalancer{}, nil
+	case "consistentHash":
+		return newConsistentHashBalancer(cfg, upstreams)
+	default:
+		return nil, fmt.Errorf("invalid balancer '%s'", strategy)
+	}
+}
+
+// cycles through each upstream in turn
+type roundRobinBalancer struct {
+	counter atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Next(_ *http.Request, candidates []*Upstream) *Upstream {
+	n := b.counter.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// smooth weighted round robin, the same algorithm nginx uses. Each upstream is picked in proportion
+// to its weight while avoiding sending bursts of consecutive requests to the heaviest upstream
+type weightedRoundRobinBalancer struct {
+	mu      sync.Mutex
+	current map[*Upstream]int
+}
+
+func (b *weightedRoundRobinBalancer) Next(_ *http.Request, candidates []*Upstream) *Upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Upstream
+	total := 0
+	for _, upstream := range candidates {
+		b.current[upstream] += upstream.Weight
+		total += upstream.Weight
+		if best == nil || b.current[upstream] > b.current[best] {
+			best = upstream
+		}
+	}
+	b.current[best] -= total
+
+	return best
+}
+
+// picks the upstream with the fewest in-flight requests, rotating the starting point so ties are
+// spread evenly
+type leastConnectionsBalancer struct {
+	counter atomic.Uint64
+}
+
+func (b *leastConnectionsBalancer) Next(_ *http.Request, candidates []*Upstream) *Upstream {
+	start := int((b.counter.Add(1) - 1) % uint64(len(candidates)))
+
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		upstream := candidates[(start+i)%len(candidates)]
+		if upstream.ActiveRequests() < best.ActiveRequests() {
+			best = upstream
+		}
+	}
+
+	return best
+}
+
+// picks two upstreams at random and uses the one with fewer in-flight requests
+type randomTwoChoicesBalancer struct{}
+
+func (randomTwoChoicesBalancer) Next(_ *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := candidates[i], candidates[j]
+	if b.ActiveRequests() < a.ActiveRequests() {
+		return b
+	}
+	return a
+}
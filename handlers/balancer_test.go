@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// returns an upstream for each name with the given weights, or a weight of one if none are given
+func testUpstreams(names string, weights ...int) []*Upstream {
+	upstreams := []*Upstream{}
+	for i, name := range strings.Split(names, " ") {
+		upstream := &Upstream{URL: &url.URL{Scheme: "http", Host: name}, Weight: 1}
+		if i < len(weights) {
+			upstream.Weight = weights[i]
+		}
+		upstream.healthy.Store(true)
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
+
+// returns the hosts of the upstreams picked for n requests in a row
+func picks(b Balancer, candidates []*Upstream, n int) string {
+	picked := make([]string, n)
+	for i := range picked {
+		picked[i] = b.Next(httptest.NewRequest(http.MethodGet, "/", nil), candidates).URL.Host
+	}
+	return strings.Join(picked, " ")
+}
+
+func TestBalancerSelection(t *testing.T) {
+	tests := []struct {
+		balancer string
+		weights  []int
+		want     string
+	}{
+		{"roundRobin", nil, "a b c a b c"},
+		{"roundRobin", []int{5, 1, 1}, "a b c a b c"},
+		// the heaviest upstream's turns are spread out rather than taken in a burst
+		{"weightedRoundRobin", []int{5, 1, 1}, "a a b a c a a"},
+		{"weightedRoundRobin", []int{1, 1, 1}, "a b c a b c"},
+		// with nothing in flight least connections rotates between the upstreams
+		{"leastConnections", nil, "a b c a b c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.balancer, func(t *testing.T) {
+			upstreams := testUpstreams("a b c", tt.weights...)
+			balancer, err := newBalancer(config.NewTable(map[string]any{"balancer": tt.balancer}), upstreams)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := picks(balancer, upstreams, len(strings.Fields(tt.want))); got != tt.want {
+				t.Errorf("picked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalancerPrefersIdleUpstreams(t *testing.T) {
+	for _, balancer := range []string{"leastConnections", "randomTwoChoices"} {
+		t.Run(balancer, func(t *testing.T) {
+			upstreams := testUpstreams("a b")
+			upstreams[0].active.Store(3)
+			b, err := newBalancer(config.NewTable(map[string]any{"balancer": balancer}), upstreams)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := picks(b, upstreams, 4); got != "b b b b" {
+				t.Errorf("picked %q, want only the idle upstream", got)
+			}
+		})
+	}
+}
+
+func TestNewBalancerErrors(t *testing.T) {
+	if _, err := newBalancer(config.NewTable(map[string]any{"balancer": "fastest"}), testUpstreams("a")); err == nil {
+		t.Error("expected an error for an unknown balancer")
+	}
+}
+
+func TestUpstreamActiveRequests(t *testing.T) {
+	var proxy *ReverseProxyService
+	var during int64
+	proxy = newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		during = proxy.split.upstreams()[0].ActiveRequests()
+	}, map[string]any{})
+
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if during != 1 {
+		t.Errorf("%d active requests while proxying, want 1", during)
+	}
+	if after := proxy.split.upstreams()[0].ActiveRequests(); after != 0 {
+		t.Errorf("%d active requests once done, want 0", after)
+	}
+}
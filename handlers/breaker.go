@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// settings shared by the circuit breakers of every upstream in a service
+type breakerSettings struct {
+	// fraction of failed requests within a window that trips the breaker
+	failureRatio float64
+	// the breaker won't trip until a window has seen at least this many requests
+	minRequests int
+	window      time.Duration
+	// how long the breaker stays open before letting probe requests through
+	cooldown time.Duration
+	// number of probe requests that must succeed while half-open before the breaker closes again
+	halfOpenRequests int
+}
+
+func buildBreakerSettings(cfg *config.Table) (*breakerSettings, error) {
+	settings := &breakerSettings{
+		failureRatio:     cfg.Float("failureRatio", 0.5),
+		minRequests:      cfg.Int("minRequests", 10),
+		window:           cfg.Duration("window", 10*time.Second),
+		cooldown:         cfg.Duration("cooldown", 30*time.Second),
+		halfOpenRequests: cfg.Int("halfOpenRequests", 1),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if settings.failureRatio <= 0 || settings.failureRatio > 1 {
+		return nil, fmt.Errorf("circuitBreaker failureRatio must be between 0 and 1")
+	}
+	if settings.minRequests < 1 || settings.halfOpenRequests < 1 {
+		return nil, fmt.Errorf("circuitBreaker minRequests and halfOpenRequests must be at least 1")
+	}
+	if settings.window <= 0 || settings.cooldown <= 0 {
+		return nil, fmt.Errorf("circuitBreaker window and cooldown must be positive")
+	}
+
+	return settings, nil
+}
+
+// tracks failures of live requests to an upstream and stops traffic to it when too many of them fail
+type circuitBreaker struct {
+	mu       sync.Mutex
+	settings *breakerSettings
+	name     string
+
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+
+	// probe requests sent and passed since the breaker became half-open
+	probes    int
+	successes int
+}
+
+func newCircuitBreaker(settings *breakerSettings, name string) *circuitBreaker {
+	return &circuitBreaker{settings: settings, name: name, windowStart: time.Now()}
+}
+
+// moves the breaker to a new state, logging the transition
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+
+	switch state {
+	case breakerOpen:
+		slog.Warn(fmt.Sprintf("circuit breaker for %s opened", b.name))
+		b.openedAt = time.Now()
+	case breakerHalfOpen:
+		slog.Info(fmt.Sprintf("circuit breaker for %s is half-open, sending probe requests", b.name))
+		b.probes = 0
+		b.successes = 0
+	case breakerClosed:
+		slog.Info(fmt.Sprintf("circuit breaker for %s closed", b.name))
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.failures = 0
+	}
+	b.state = state
+}
+
+// returns the state the breaker is currently in
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// reports whether a request may be sent to the upstream without reserving a slot for it
+func (b *circuitBreaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.settings.cooldown
+	case breakerHalfOpen:
+		return b.probes < b.settings.halfOpenRequests
+	}
+	return true
+}
+
+// reserves a slot for a request about to be sent to the upstream, returning false if the breaker won't let it through.
+// The check and the reservation happen under the same lock so concurrent requests can't take more probe slots than
+// there are
+func (b *circuitBreaker) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.settings.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	}
+	if b.state == breakerHalfOpen {
+		if b.probes >= b.settings.halfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// records the outcome of a request sent to the upstream
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if !success {
+			b.setState(breakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.halfOpenRequests {
+			b.setState(breakerClosed)
+		}
+	case breakerClosed:
+		if time.Since(b.windowStart) > b.settings.window {
+			b.windowStart = time.Now()
+			b.requests = 0
+			b.failures = 0
+		}
+
+		b.requests++
+		if !success {
+			b.failures++
+		}
+
+		if b.requests >= b.settings.minRequests &&
+			float64(b.failures)/float64(b.requests) >= b.settings.failureRatio {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// releases the slot reserved by acquire for a request whose outcome says nothing about the upstream, such as one
+// cancelled by the client
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func testBreakerSettings() *breakerSettings {
+	return &breakerSettings{
+		failureRatio:     0.5,
+		minRequests:      4,
+		window:           time.Minute,
+		cooldown:         time.Minute,
+		halfOpenRequests: 2,
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []bool
+		want     breakerState
+	}{
+		{"stays closed while successful", []bool{true, true, true, true, true}, breakerClosed},
+		{"waits for the minimum requests", []bool{false, false, false}, breakerClosed},
+		{"opens at the failure ratio", []bool{true, false, true, false}, breakerOpen},
+		{"stays closed below the failure ratio", []bool{true, true, true, false, true}, breakerClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(testBreakerSettings(), "test")
+			for _, success := range tt.outcomes {
+				if !b.acquire() {
+					t.Fatal("acquire failed while closed")
+				}
+				b.record(success)
+			}
+			if got := b.currentState(); got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name             string
+		halfOpenRequests int
+		outcomes         []bool
+		want             breakerState
+	}{
+		{"closes after a single probe", 1, []bool{true}, breakerClosed},
+		{"closes once every probe succeeds", 3, []bool{true, true, true}, breakerClosed},
+		{"stays half-open until every probe succeeds", 3, []bool{true, true}, breakerHalfOpen},
+		{"opens again when the only probe fails", 1, []bool{false}, breakerOpen},
+		{"opens again when any probe fails", 3, []bool{true, false}, breakerOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := testBreakerSettings()
+			settings.halfOpenRequests = tt.halfOpenRequests
+			b := newCircuitBreaker(settings, "test")
+			b.setState(breakerOpen)
+			if b.ready() || b.acquire() {
+				t.Fatal("breaker let a request through before its cooldown")
+			}
+
+			b.openedAt = time.Now().Add(-time.Hour)
+			admitted := 0
+			for b.acquire() && admitted <= tt.halfOpenRequests {
+				admitted++
+			}
+			if admitted != tt.halfOpenRequests {
+				t.Fatalf("admitted %d probes, want %d", admitted, tt.halfOpenRequests)
+			}
+			if b.currentState() != breakerHalfOpen || b.ready() {
+				t.Fatalf("state = %s with ready = %v, want half-open and not ready", b.currentState(), b.ready())
+			}
+
+			for _, success := range tt.outcomes {
+				b.record(success)
+			}
+			if got := b.currentState(); got != tt.want {
+				t.Fatalf("state = %s, want %s", got, tt.want)
+			}
+
+			// a breaker that opened again waits out a fresh cooldown, while a closed one takes any number of requests
+			switch tt.want {
+			case breakerOpen:
+				if b.ready() || b.acquire() {
+					t.Error("breaker let a request through straight after reopening")
+				}
+			case breakerClosed:
+				for range 2 * tt.halfOpenRequests {
+					if !b.acquire() {
+						t.Fatal("acquire failed once closed")
+					}
+					b.record(true)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerReleaseFreesProbe(t *testing.T) {
+	b := newCircuitBreaker(testBreakerSettings(), "test")
+	b.setState(breakerHalfOpen)
+
+	for i := 0; i < b.settings.halfOpenRequests; i++ {
+		b.acquire()
+	}
+	if b.ready() {
+		t.Fatal("ready with every probe slot taken")
+	}
+	b.release()
+	if !b.acquire() {
+		t.Fatal("acquire failed after a probe slot was released")
+	}
+}
+
+func TestCircuitBreakerConcurrentProbes(t *testing.T) {
+	b := newCircuitBreaker(testBreakerSettings(), "test")
+	b.setState(breakerOpen)
+	b.openedAt = time.Now().Add(-time.Hour)
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.acquire() {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := admitted.Load(); got != int64(b.settings.halfOpenRequests) {
+		t.Errorf("admitted %d probes, want %d", got, b.settings.halfOpenRequests)
+	}
+}
+
+// a probe request that fails before it reaches the upstream, here because the client's body can't be read for a
+// retry, must give its slot back or the breaker would stay half-open with no way to send another probe
+func TestCircuitBreakerFreesProbeOfUnsentRequest(t *testing.T) {
+	var hits atomic.Int64
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}, map[string]any{
+		"retry":          map[string]any{"attempts": 2},
+		"circuitbreaker": map[string]any{"halfopenrequests": 1},
+	})
+	breaker := proxy.split.upstreams()[0].breaker
+	breaker.setState(breakerOpen)
+	breaker.openedAt = time.Now().Add(-time.Hour)
+
+	r := httptest.NewRequest(http.MethodPut, "/", iotest.ErrReader(errors.New("client went away")))
+	proxy.ServeHTTP(httptest.NewRecorder(), r)
+	if hits.Load() != 0 {
+		t.Fatal("request with an unreadable body reached the upstream")
+	}
+	if got := breaker.currentState(); got != breakerHalfOpen {
+		t.Fatalf("state = %s, want half-open", got)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("probe after the failed request got %d", w.Code)
+	}
+	if got := breaker.currentState(); got != breakerClosed {
+		t.Errorf("state = %s, want closed", got)
+	}
+}
@@ -0,0 +1,552 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// the response header that tells clients how the cache handled their request
+const cacheStatusHeader = "X-Cache"
+
+// values of the cache status header
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// headers of a 304 response that must not replace the stored ones, along with headers that are never stored
+var cacheIgnoredHeaders = []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding",
+	"Set-Cookie", cacheStatusHeader}
+
+// rules for which parts of a request make up its cache key. By default the key is the host, path and query string
+type cacheKeyRules struct {
+	includeHost bool
+	ignoreQuery bool
+	// the query parameters included in the key, or nil to include all of them
+	query   []string
+	headers []string
+	cookies []string
+}
+
+func buildCacheKeyRules(cfg *config.Table) *cacheKeyRules {
+	rules := &cacheKeyRules{
+		includeHost: cfg.Bool("includeHost", true),
+		ignoreQuery: cfg.Bool("ignoreQuery", false),
+		headers:     cfg.StringSlice("headers"),
+		cookies:     cfg.StringSlice("cookies"),
+	}
+	if cfg.Has("query") {
+		rules.query = append([]string{}, cfg.StringSlice("query")...)
+	}
+	return rules
+}
+
+// returns the key shared by every variant of the response to a request
+func (k *cacheKeyRules) primaryKey(r *http.Request) string {
+	var b strings.Builder
+	if k.includeHost {
+		b.WriteString(strings.ToLower(r.Host))
+	}
+	b.WriteString(r.URL.EscapedPath())
+
+	if !k.ignoreQuery {
+		query := r.URL.Query()
+		if k.query != nil {
+			for name := range query {
+				if !slices.Contains(k.query, name) {
+					delete(query, name)
+				}
+			}
+		}
+		// encoding sorts the parameters so their order doesn't matter
+		if len(query) > 0 {
+			b.WriteString("?" + query.Encode())
+		}
+	}
+
+	for _, name := range k.headers {
+		fmt.Fprintf(&b, "\n%s: %s", http.CanonicalHeaderKey(name), strings.Join(r.Header.Values(name), ", "))
+	}
+	for _, name := range k.cookies {
+		value := ""
+		if cookie, err := r.Cookie(name); err == nil {
+			value = cookie.Value
+		}
+		fmt.Fprintf(&b, "\ncookie %s=%s", name, value)
+	}
+	return b.String()
+}
+
+// returns the key of the variant of a response that matches the request's values of the headers the response varies
+// on
+func variantKey(primaryKey string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(primaryKey + "\x00")
+	for _, name := range vary {
+		fmt.Fprintf(&b, "%s=%s\x00", name, strings.Join(r.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// caches the responses of a reverse proxy service following RFC 9111
+type responseCache struct {
+	name         string
+	store        cacheStore
+	keys         *cacheKeyRules
+	maxEntrySize int64
+	// the upstream response header listing the surrogate keys a response is tagged with. It isn't sent to clients
+	tagHeader string
+
+	mu sync.Mutex
+	// the headers the most recently stored response for each primary key varies on
+	varies map[string][]string
+	// keys that are currently being revalidated in the background
+	revalidating map[string]bool
+
+	coalesce        bool
+	coalesceTimeout time.Duration
+	// fetches that identical requests can wait on, by flight key
+	inflight map[string]*inflightFetch
+	// flight keys whose last response couldn't be cached along with when to start coalescing them again
+	uncacheable map[string]time.Time
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	stale       atomic.Int64
+	revalidated atomic.Int64
+	bypassed    atomic.Int64
+	coalesced   atomic.Int64
+}
+
+func buildResponseCache(cfg *config.Table, name string) (*responseCache, error) {
+	maxSize := cfg.Size("maxSize", 64<<20)
+	maxEntrySize := cfg.Size("maxEntrySize", 1<<20)
+	diskPath := cfg.String("diskPath", "")
+	diskMaxSize := cfg.Size("diskMaxSize", 1<<30)
+	keys := buildCacheKeyRules(cfg.Table("key"))
+	tagHeader := http.CanonicalHeaderKey(cfg.String("tagHeader", "Surrogate-Key"))
+	coalesce := cfg.Bool("coalesce", false)
+	coalesceTimeout := cfg.Duration("coalesceTimeout", 5*time.Second)
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if maxSize <= 0 || maxEntrySize <= 0 || diskMaxSize <= 0 {
+		return nil, fmt.Errorf("cache sizes must be positive")
+	}
+	if maxEntrySize > maxSize {
+		return nil, fmt.Errorf("cache maxEntrySize must not be larger than maxSize")
+	}
+	if coalesceTimeout <= 0 {
+		return nil, fmt.Errorf("cache coalesceTimeout must be positive")
+	}
+
+	c := &responseCache{
+		name:         name,
+		keys:         keys,
+		maxEntrySize: maxEntrySize,
+		tagHeader:    tagHeader,
+		varies:       map[string][]string{},
+		revalidating: map[string]bool{},
+
+		coalesce:        coalesce,
+		coalesceTimeout: coalesceTimeout,
+		inflight:        map[string]*inflightFetch{},
+		uncacheable:     map[string]time.Time{},
+	}
+
+	// the headers a URL varies on are forgotten once none of its variants are left in the store that holds every
+	// entry, which is the disk store when there is one
+	memory := newMemoryStore(maxSize)
+	c.store = memory
+	memory.variants.onEmpty = c.forget
+	if diskPath != "" {
+		disk, err := newDiskStore(diskPath, diskMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		memory.variants.onEmpty = nil
+		disk.variants.onEmpty = c.forget
+		c.store = &tieredStore{memory: memory, disk: disk}
+	}
+
+	c.store.each(func(entry *cacheEntry) {
+		c.varies[entry.PrimaryKey] = parseVary(entry.Header)
+	})
+
+	return c, nil
+}
+
+// returns the cache's statistics for the debug endpoint
+func (c *responseCache) debugInfo() map[string]any {
+	entries, size := c.store.stats()
+	return map[string]any{
+		"entries":     entries,
+		"size":        size,
+		"hits":        c.hits.Load(),
+		"misses":      c.misses.Load(),
+		"stale":       c.stale.Load(),
+		"revalidated": c.revalidated.Load(),
+		"bypassed":    c.bypassed.Load(),
+		"coalesced":   c.coalesced.Load(),
+	}
+}
+
+// returns the stored response that matches the request, if there is one
+func (c *responseCache) lookup(r *http.Request, primaryKey string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	vary, exists := c.varies[primaryKey]
+	c.mu.Unlock()
+	if !exists {
+		return nil, false
+	}
+	return c.store.get(variantKey(primaryKey, vary, r))
+}
+
+// forgets the headers a URL varies on once none of its variants are stored. It is called by the store, with the
+// store's lock held
+func (c *responseCache) forget(primaryKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.varies, primaryKey)
+}
+
+// removes every stored variant of a URL, as required after an unsafe request to it
+func (c *responseCache) invalidate(primaryKey string) {
+	c.mu.Lock()
+	_, exists := c.varies[primaryKey]
+	delete(c.varies, primaryKey)
+	c.mu.Unlock()
+
+	if exists {
+		c.store.removeWhere(func(entry *cacheEntry) bool {
+			return entry.PrimaryKey == primaryKey
+		})
+	}
+}
+
+// answers a request from the cache where possible, calling forward to send it to the upstream otherwise
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, forward http.HandlerFunc) {
+	// upgrades and partial requests are passed straight through
+	if isUpgradeRequest(r) || r.Header.Get("Range") != "" {
+		c.bypassed.Add(1)
+		forward(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		c.bypassed.Add(1)
+		cw := newCaptureWriter(w, cacheBypass, c.tagHeader, 0, nil)
+		forward(cw, r)
+
+		// a successful unsafe request may have changed the resource so stored responses for it are dropped
+		if isUnsafeMethod(r.Method) && cw.status >= 200 && cw.status < 400 {
+			c.invalidate(c.keys.primaryKey(r))
+		}
+		return
+	}
+
+	reqCC := requestCacheControl(r)
+	primaryKey := c.keys.primaryKey(r)
+	entry, found := c.lookup(r, primaryKey)
+	if !found {
+		if reqCC.has("only-if-cached") {
+			templates.WriteError(w, http.StatusGatewayTimeout, "Gateway Timeout")
+			return
+		}
+		c.fetchCoalesced(w, r, forward, primaryKey, nil)
+		return
+	}
+
+	switch entry.decide(reqCC, time.Now()) {
+	case cacheUseStored:
+		c.hits.Add(1)
+		c.write(w, r, entry, cacheHit)
+	case cacheUseStale:
+		c.stale.Add(1)
+		c.write(w, r, entry, cacheStale)
+		c.revalidateInBackground(r, primaryKey, entry, forward)
+	default:
+		if reqCC.has("only-if-cached") {
+			templates.WriteError(w, http.StatusGatewayTimeout, "Gateway Timeout")
+			return
+		}
+		c.fetchCoalesced(w, r, forward, primaryKey, entry)
+	}
+}
+
+// sends a stored response to the client, or a 304 if the client's conditional headers match it
+func (c *responseCache) write(w http.ResponseWriter, r *http.Request, entry *cacheEntry, status string) {
+	entry.hits.Add(1)
+
+	header := w.Header()
+	for name, values := range entry.Header {
+		if name != c.tagHeader {
+			header[name] = slices.Clone(values)
+		}
+	}
+	header.Set("Age", strconv.Itoa(int(entry.age(time.Now()).Seconds())))
+	header.Set(cacheStatusHeader, status)
+
+	if notModified(r, entry.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// sends the request to the upstream and stores the response if it can be, returning whether it was stored and whether
+// it could never have been, such as a response marked no-store, rather than missing out this once because the
+// upstream failed or the response was cut short. If stored is set the request is made conditional on it so the
+// upstream can answer with 304 Not Modified, and stored is sent instead of an error if its stale-if-error allows
+func (c *responseCache) fetch(w http.ResponseWriter, r *http.Request, forward http.HandlerFunc, primaryKey string, stored *cacheEntry) (bool, bool) {
+	out := r
+	validating := stored != nil && stored.hasValidators() && r.Method == http.MethodGet
+	if validating {
+		out = r.Clone(r.Context())
+		out.Header.Del("If-None-Match")
+		out.Header.Del("If-Modified-Since")
+		if etag := stored.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := stored.Header.Get("Last-Modified"); lastModified != "" {
+			out.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := time.Now()
+	uncacheable := false
+	cw := newCaptureWriter(w, cacheMiss, c.tagHeader, c.maxEntrySize, func(status int, header http.Header) (bool, bool) {
+		if validating && status == http.StatusNotModified {
+			return true, false
+		}
+		if stored != nil && status >= 500 && stored.age(time.Now())-stored.Lifetime <= stored.StaleIfError {
+			return true, false
+		}
+		storable := responseStorable(r, status, header)
+		// an upstream error is likely gone by the next request so it doesn't make the URL uncacheable
+		uncacheable = !storable && status < 500
+		return false, storable
+	})
+	forward(cw, out)
+	responseTime := time.Now()
+
+	switch {
+	case cw.held && cw.status == http.StatusNotModified:
+		c.revalidated.Add(1)
+		updated := c.refresh(stored, cw.header, requestTime, responseTime)
+		c.store.set(updated)
+		c.write(w, r, updated, cacheRevalidated)
+		return true, false
+	case cw.held:
+		c.stale.Add(1)
+		c.write(w, r, stored, cacheStale)
+	case cw.keep && !cw.overflow:
+		return c.storeResponse(r, primaryKey, cw, requestTime, responseTime), false
+	}
+	return false, uncacheable
+}
+
+// returns a copy of a stored entry updated with the headers of a 304 response, following RFC 9111 section 4.3.4
+func (c *responseCache) refresh(stored *cacheEntry, header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	merged := stored.Header.Clone()
+	for name, values := range header {
+		if !slices.Contains(cacheIgnoredHeaders, name) {
+			merged[name] = slices.Clone(values)
+		}
+	}
+
+	entry := newCacheEntry(stored.Key, stored.PrimaryKey, stored.URL, stored.Status, merged, stored.Body, requestTime, responseTime)
+	entry.Tags = c.tags(merged)
+	entry.hits = stored.hits
+	return entry
+}
+
+// stores a response captured from the upstream, returning false if it can't be stored
+func (c *responseCache) storeResponse(r *http.Request, primaryKey string, cw *captureWriter, requestTime, responseTime time.Time) bool {
+	header := cw.header.Clone()
+	header.Del(cacheStatusHeader)
+
+	// a response cut short by the upstream must not be stored
+	body := bytes.Clone(cw.body.Bytes())
+	if length := header.Get("Content-Length"); length != "" && length != strconv.Itoa(len(body)) {
+		return false
+	}
+
+	vary := parseVary(header)
+	key := variantKey(primaryKey, vary, r)
+	entry := newCacheEntry(key, primaryKey, strings.ToLower(r.Host)+r.URL.RequestURI(), cw.status, header, body, requestTime, responseTime)
+	entry.Tags = c.tags(header)
+
+	// a response that is never fresh is only worth keeping if it can be revalidated
+	if entry.Lifetime == 0 && !entry.hasValidators() && entry.StaleWhileRevalidate == 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	c.varies[primaryKey] = vary
+	c.mu.Unlock()
+	c.store.set(entry)
+	return true
+}
+
+// returns the surrogate keys a response is tagged with, separated by spaces or commas
+func (c *responseCache) tags(header http.Header) []string {
+	var tags []string
+	for _, value := range header.Values(c.tagHeader) {
+		tags = append(tags, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ' ' || r == ','
+		})...)
+	}
+	return tags
+}
+
+// revalidates a stale entry without holding up the client's request. Only one revalidation per entry runs at a time
+func (c *responseCache) revalidateInBackground(r *http.Request, primaryKey string, stored *cacheEntry, forward http.HandlerFunc) {
+	c.mu.Lock()
+	if c.revalidating[stored.Key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[stored.Key] = true
+	c.mu.Unlock()
+
+	// the revalidation must outlive the client's request, which finishes as soon as the stale response is sent
+	out := r.Clone(context.WithoutCancel(r.Context()))
+	out.Method = http.MethodGet
+	out.Body = http.NoBody
+	out.ContentLength = 0
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, stored.Key)
+			c.mu.Unlock()
+		}()
+		c.fetch(discardResponseWriter{header: http.Header{}}, out, forward, primaryKey, stored)
+	}()
+}
+
+// reports whether a request method can change the resource it targets
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// sits between the reverse proxy and the client and keeps a copy of the response so it can be stored. Once the
+// status is known, decide reports whether the response should be held back from the client so the cache can send
+// something else, and whether it should be kept for storing
+type captureWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	cacheStatus string
+	// a header kept from the client, such as the cache's tag header
+	hidden string
+	decide func(status int, header http.Header) (hold bool, keep bool)
+
+	status int
+	held   bool
+	keep   bool
+
+	body  bytes.Buffer
+	limit int64
+	// set once the body grows past limit, at which point it is no longer kept
+	overflow bool
+}
+
+func newCaptureWriter(w http.ResponseWriter, cacheStatus, hidden string, limit int64, decide func(int, http.Header) (bool, bool)) *captureWriter {
+	return &captureWriter{w: w, header: http.Header{}, cacheStatus: cacheStatus, hidden: hidden, limit: limit, decide: decide}
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	// informational responses can't be cached and are dropped since a final response may still be held back
+	if cw.status != 0 || (status < 200 && status != http.StatusSwitchingProtocols) {
+		return
+	}
+	cw.status = status
+
+	if cw.decide != nil {
+		cw.held, cw.keep = cw.decide(status, cw.header)
+	}
+	if cw.held {
+		return
+	}
+
+	header := cw.w.Header()
+	for name, values := range cw.header {
+		if name != cw.hidden {
+			header[name] = values
+		}
+	}
+	header.Set(cacheStatusHeader, cw.cacheStatus)
+	cw.w.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.keep && !cw.overflow {
+		if int64(cw.body.Len()+len(p)) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+
+	if cw.held {
+		return len(p), nil
+	}
+	return cw.w.Write(p)
+}
+
+// flushes the response to the client so streamed responses still stream when caching is enabled
+func (cw *captureWriter) Flush() {
+	if cw.status == 0 || cw.held {
+		return
+	}
+	http.NewResponseController(cw.w).Flush()
+}
+
+// a response writer for requests made on the cache's behalf, whose responses nobody reads
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w discardResponseWriter) WriteHeader(int) {}
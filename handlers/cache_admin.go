@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serves the endpoints used to inspect and purge the caches of reverse proxy services
+type CacheAdminHandler struct {
+	mu     sync.Mutex
+	caches map[string]*responseCache
+}
+
+func NewCacheAdminHandler() *CacheAdminHandler {
+	return &CacheAdminHandler{caches: map[string]*responseCache{}}
+}
+
+// adds the cache of a service to the admin endpoints. Services without a cache are ignored
+func (a *CacheAdminHandler) Register(name string, service *ReverseProxyService) {
+	if service.cache == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.caches[name] = service.cache
+}
+
+// returns the caches selected by the service query parameter, or every cache if it isn't set
+func (a *CacheAdminHandler) selectCaches(query url.Values) map[string]*responseCache {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	service := query.Get("service")
+	if service == "" {
+		return maps.Clone(a.caches)
+	}
+	if cache, exists := a.caches[service]; exists {
+		return map[string]*responseCache{service: cache}
+	}
+	return map[string]*responseCache{}
+}
+
+// splits a URL given to the admin endpoints, or stored with an entry, into its host and request URI. The scheme is
+// ignored and a URL starting with "/" has no host, so it matches that path on any host
+func splitCacheURL(raw string) (string, string) {
+	if _, rest, found := strings.Cut(raw, "://"); found {
+		raw = rest
+	}
+	if strings.HasPrefix(raw, "/") {
+		return "", raw
+	}
+
+	host, target, found := strings.Cut(raw, "/")
+	if !found {
+		return strings.ToLower(host), "/"
+	}
+	return strings.ToLower(host), "/" + target
+}
+
+// builds a filter for cache entries from the url, prefix and tag query parameters, all of which must match. It
+// returns false if none of them are set
+func cacheEntryFilter(query url.Values) (func(*cacheEntry) bool, bool) {
+	rawURL, prefix, tag := query.Get("url"), query.Get("prefix"), query.Get("tag")
+	if rawURL == "" && prefix == "" && tag == "" {
+		return func(*cacheEntry) bool { return true }, false
+	}
+
+	urlHost, urlTarget := splitCacheURL(rawURL)
+	prefixHost, prefixTarget := splitCacheURL(prefix)
+
+	return func(entry *cacheEntry) bool {
+		host, target := splitCacheURL(entry.URL)
+		if rawURL != "" && (target != urlTarget || (urlHost != "" && host != urlHost)) {
+			return false
+		}
+		if prefix != "" && (!strings.HasPrefix(target, prefixTarget) || (prefixHost != "" && host != prefixHost)) {
+			return false
+		}
+		if tag != "" && !slices.Contains(entry.Tags, tag) {
+			return false
+		}
+		return true
+	}, true
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// lists the cached entries of every service, or of the service given in the query string. Entries can be filtered
+// with the same url, prefix and tag parameters as Purge
+func (a *CacheAdminHandler) ListEntries(w http.ResponseWriter, r *http.Request) {
+	filter, _ := cacheEntryFilter(r.URL.Query())
+	now := time.Now()
+
+	entries := []map[string]any{}
+	for name, cache := range a.selectCaches(r.URL.Query()) {
+		cache.store.each(func(entry *cacheEntry) {
+			if !filter(entry) {
+				return
+			}
+			entries = append(entries, map[string]any{
+				"service": name,
+				"url":     entry.URL,
+				"status":  entry.Status,
+				"size":    entry.size(),
+				"age":     int(entry.age(now).Seconds()),
+				"fresh":   entry.age(now) < entry.Lifetime,
+				"hits":    entry.hits.Load(),
+				"tags":    entry.Tags,
+			})
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i]["service"] != entries[j]["service"] {
+			return entries[i]["service"].(string) < entries[j]["service"].(string)
+		}
+		return entries[i]["url"].(string) < entries[j]["url"].(string)
+	})
+
+	writeJSON(w, map[string]any{"entries": entries})
+}
+
+// removes entries matching the url, prefix or tag query parameters from every cache, or from the cache of the service
+// given in the query string. Giving only a service purges its whole cache
+func (a *CacheAdminHandler) Purge(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, filtered := cacheEntryFilter(query)
+	if !filtered && query.Get("service") == "" {
+		http.Error(w, "one of url, prefix, tag or service must be given", http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	for _, cache := range a.selectCaches(query) {
+		purged += cache.store.removeWhere(filter)
+	}
+
+	writeJSON(w, map[string]any{"purged": purged})
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// the URLs cached by each service in fillCaches
+var cachedURLs = map[string][]string{
+	"api": {"example.com/products/1", "example.com/products/2", "other.example.com/products/1", "example.com/static/app.js"},
+	"web": {"example.com/products/1"},
+}
+
+// returns an admin handler for the services "api" and "web" after filling their caches with cachedURLs. Their
+// upstreams tag every response with "all" and the last part of its path
+func fillCaches(t *testing.T) *CacheAdminHandler {
+	admin := NewCacheAdminHandler()
+	for _, name := range []string{"api", "web"} {
+		proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Surrogate-Key", "all "+r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		}, map[string]any{"cache": map[string]any{}})
+		admin.Register(name, proxy)
+
+		for _, url := range cachedURLs[name] {
+			host, path, _ := strings.Cut(url, "/")
+			r := httptest.NewRequest(http.MethodGet, "/"+path, nil)
+			r.Host = host
+			proxy.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	}
+	return admin
+}
+
+func TestCacheAdminPurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantPurged int
+	}{
+		{"url on any host", "url=/products/1", http.StatusOK, 3},
+		{"url on one host", "url=example.com/products/1", http.StatusOK, 2},
+		{"url with a scheme", "url=https://other.example.com/products/1", http.StatusOK, 1},
+		{"url host is case-insensitive", "url=Example.COM/products/2", http.StatusOK, 1},
+		{"url must match the whole path", "url=/products", http.StatusOK, 0},
+		{"prefix", "prefix=/products/", http.StatusOK, 4},
+		{"prefix on one host", "prefix=other.example.com/", http.StatusOK, 1},
+		{"tag", "tag=1", http.StatusOK, 3},
+		{"tag must match a whole key", "tag=app", http.StatusOK, 0},
+		{"filters are combined", "tag=1&prefix=example.com/", http.StatusOK, 2},
+		{"service", "service=web", http.StatusOK, 1},
+		{"service with a filter", "service=api&url=/products/1", http.StatusOK, 2},
+		{"unknown service", "service=missing", http.StatusOK, 0},
+		{"no filter", "", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := fillCaches(t)
+
+			w := httptest.NewRecorder()
+			admin.Purge(w, httptest.NewRequest(http.MethodPost, "/debug/cache/purge?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var result struct{ Purged int }
+			json.NewDecoder(w.Body).Decode(&result)
+			if result.Purged != tt.wantPurged {
+				t.Errorf("purged %d entries, want %d", result.Purged, tt.wantPurged)
+			}
+			// what was purged must be gone rather than just counted
+			if remaining := len(listCacheEntries(t, admin, "")); remaining != 5-tt.wantPurged {
+				t.Errorf("%d entries remain, want %d", remaining, 5-tt.wantPurged)
+			}
+		})
+	}
+}
+
+// returns the services and URLs listed by the admin handler for the query
+func listCacheEntries(t *testing.T, admin *CacheAdminHandler, query string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	admin.ListEntries(w, httptest.NewRequest(http.MethodGet, "/debug/cache?"+query, nil))
+
+	var result struct {
+		Entries []struct{ Service, URL string }
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	listed := make([]string, len(result.Entries))
+	for i, entry := range result.Entries {
+		listed[i] = entry.Service + " " + entry.URL
+	}
+	return listed
+}
+
+func TestCacheAdminListEntries(t *testing.T) {
+	admin := fillCaches(t)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{
+			"api example.com/products/1", "api example.com/products/2", "api example.com/static/app.js",
+			"api other.example.com/products/1", "web example.com/products/1",
+		}},
+		{"service=web", []string{"web example.com/products/1"}},
+		{"service=api&prefix=/static/", []string{"api example.com/static/app.js"}},
+		{"tag=2", []string{"api example.com/products/2"}},
+	}
+
+	for _, tt := range tests {
+		if got := listCacheEntries(t, admin, tt.query); strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("%q listed %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grqphical/interchange/middleware"
+)
+
+// the longest a response without explicit freshness information is considered fresh for based on its Last-Modified
+// header
+const maxHeuristicLifetime = 24 * time.Hour
+
+// status codes that may be cached without explicit freshness information, from RFC 9110 section 15.1
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// the directives of a Cache-Control header. Directives without an argument map to an empty string
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			// the first occurrence of a directive wins
+			if _, exists := cc[name]; !exists {
+				cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// parses the Cache-Control header of a request, treating the legacy `Pragma: no-cache` as `no-cache` when the
+// request has no Cache-Control header
+func requestCacheControl(r *http.Request) cacheControl {
+	cc := parseCacheControl(r.Header)
+	if len(cc) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, exists := cc[directive]
+	return exists
+}
+
+// returns the argument of a directive as a duration, or false if the directive is missing or its argument isn't a
+// number of seconds
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, exists := cc[directive]
+	if !exists {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// returns the request headers a response varies on, with "*" meaning it varies on something other than headers
+func parseVary(header http.Header) []string {
+	var vary []string
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+	slices.Sort(vary)
+	return vary
+}
+
+// reports whether a shared cache may store the response to a request, following RFC 9111 section 3
+func responseStorable(r *http.Request, status int, header http.Header) bool {
+	if r.Method != http.MethodGet || status < 200 || status == http.StatusPartialContent ||
+		status == http.StatusNotModified {
+		return false
+	}
+	if requestCacheControl(r).has("no-store") {
+		return false
+	}
+
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if slices.Contains(parseVary(header), "*") {
+		return false
+	}
+	// a cookie set for one client must never be handed to another
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	// interchange's own auth checks may have removed the credentials, so requests they let through count as
+	// authorized too
+	authorized := r.Header.Get("Authorization") != "" || middleware.Authenticated(r)
+	if authorized && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	explicit := cc.has("max-age") || cc.has("s-maxage") || cc.has("public") || header.Get("Expires") != ""
+	return explicit || heuristicallyCacheable[status]
+}
+
+// returns the Date of a response, or fallback if it has none
+func responseDate(header http.Header, fallback time.Time) time.Time {
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		return date
+	}
+	return fallback
+}
+
+// returns how long a response stays fresh for, following RFC 9111 section 4.2.1
+func freshnessLifetime(header http.Header, responseTime time.Time) time.Duration {
+	cc := parseCacheControl(header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+
+	date := responseDate(header, responseTime)
+	if expires := header.Get("Expires"); expires != "" {
+		// an invalid Expires header means the response has already expired
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return max(0, t.Sub(date))
+	}
+
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		return min(date.Sub(lastModified)/10, maxHeuristicLifetime)
+	}
+	return 0
+}
+
+// returns the age of a response when it was received, following RFC 9111 section 4.2.3
+func initialAge(header http.Header, requestTime, responseTime time.Time) time.Duration {
+	apparentAge := max(0, responseTime.Sub(responseDate(header, responseTime)))
+
+	var ageValue time.Duration
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+
+	return max(apparentAge, correctedAge)
+}
+
+// how a stored response may be used to answer a request
+type cacheDecision int
+
+const (
+	// the stored response is fresh enough to be sent as is
+	cacheUseStored cacheDecision = iota
+	// the stored response may be sent while it is revalidated in the background
+	cacheUseStale
+	// the stored response must be revalidated with the upstream first
+	cacheRevalidate
+)
+
+// decides whether the entry can answer a request with the given Cache-Control directives at time now
+func (e *cacheEntry) decide(reqCC cacheControl, now time.Time) cacheDecision {
+	if reqCC.has("no-cache") {
+		return cacheRevalidate
+	}
+
+	age := e.age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return cacheRevalidate
+	}
+
+	if age < e.Lifetime {
+		// a fresh response that won't stay fresh for as long as the client asked is fetched again rather than being
+		// treated as stale
+		if minFresh, ok := reqCC.seconds("min-fresh"); ok && age+minFresh >= e.Lifetime {
+			return cacheRevalidate
+		}
+		return cacheUseStored
+	}
+
+	staleness := age - e.Lifetime
+	if e.MustRevalidate {
+		return cacheRevalidate
+	}
+	if maxStale, exists := reqCC["max-stale"]; exists {
+		limit, ok := reqCC.seconds("max-stale")
+		if maxStale == "" || (ok && staleness <= limit) {
+			return cacheUseStored
+		}
+	}
+	if staleness <= e.StaleWhileRevalidate {
+		return cacheUseStale
+	}
+	return cacheRevalidate
+}
+
+// compares two entity tags using the weak comparison from RFC 9110 section 8.8.3.2
+func etagsMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// reports whether the conditional headers of a request are satisfied by a response with the given headers, meaning
+// a 304 Not Modified can be sent instead
+func notModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := header.Get("ETag")
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || (etag != "" && etagsMatch(tag, etag)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !lastModified.After(since)
+	}
+	return false
+}
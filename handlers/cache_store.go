@@ -0,0 +1,506 @@
+package handlers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a response stored by a cache. Fields are exported so entries can be written to disk
+type cacheEntry struct {
+	Key string
+	// the key without the values of the headers the response varies on, shared by every variant of a URL
+	PrimaryKey string
+	// the host and request URI the response was fetched for
+	URL string
+	// surrogate keys the upstream tagged the response with so it can be purged along with related responses
+	Tags []string
+
+	Status int
+	Header http.Header
+	Body   []byte
+	// the length of Body, kept so the size of entries indexed without their body is known
+	BodySize int
+
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// the age of the response when it was received
+	InitialAge time.Duration
+	// how long the response is fresh for
+	Lifetime time.Duration
+
+	// how long after going stale the response may still be sent while it is revalidated, or while the upstream is
+	// failing
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// set when the response must not be sent once stale without revalidating it first
+	MustRevalidate bool
+
+	// the number of times the entry has been served. It is shared by every copy of the entry, such as the one indexed
+	// by the disk store, and isn't written to disk
+	hits *atomic.Int64
+}
+
+// builds an entry from a response the upstream sent for the request
+func newCacheEntry(key, primaryKey, url string, status int, header http.Header, body []byte, requestTime, responseTime time.Time) *cacheEntry {
+	cc := parseCacheControl(header)
+	entry := &cacheEntry{
+		Key:          key,
+		PrimaryKey:   primaryKey,
+		URL:          url,
+		Status:       status,
+		Header:       header,
+		Body:         body,
+		BodySize:     len(body),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		InitialAge:   initialAge(header, requestTime, responseTime),
+		Lifetime:     freshnessLifetime(header, responseTime),
+		// s-maxage implies proxy-revalidate for shared caches
+		MustRevalidate: cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage") ||
+			cc.has("no-cache"),
+		hits: &atomic.Int64{},
+	}
+	if !entry.MustRevalidate {
+		entry.StaleWhileRevalidate, _ = cc.seconds("stale-while-revalidate")
+		entry.StaleIfError, _ = cc.seconds("stale-if-error")
+	}
+	return entry
+}
+
+// returns the current age of the entry, following RFC 9111 section 4.2.3
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.ResponseTime)
+}
+
+// reports whether the entry can be revalidated with a conditional request
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// returns roughly how many bytes the entry takes up in memory
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Key) + len(e.PrimaryKey) + len(e.URL) + e.BodySize)
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// where a cache keeps its entries
+type cacheStore interface {
+	get(key string) (*cacheEntry, bool)
+	set(entry *cacheEntry)
+	// removes every entry for which match returns true, returning how many were removed
+	removeWhere(match func(*cacheEntry) bool) int
+	// calls fn with every stored entry. Entries kept on disk are passed without their body
+	each(fn func(*cacheEntry))
+	// returns the number of entries and their total size in bytes
+	stats() (int, int64)
+}
+
+// an item of an lruList
+type lruItem[V any] struct {
+	key   string
+	value V
+	size  int64
+}
+
+// a set of values that evicts the least recently used ones once their total size goes over maxSize. It is not safe
+// for concurrent use
+type lruList[V any] struct {
+	maxSize int64
+	size    int64
+	// the front of the list is the most recently used item
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUList[V any](maxSize int64) *lruList[V] {
+	return &lruList[V]{maxSize: maxSize, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// reports whether the list holds a value for key without marking it as used
+func (l *lruList[V]) has(key string) bool {
+	_, exists := l.items[key]
+	return exists
+}
+
+func (l *lruList[V]) get(key string) (V, bool) {
+	element, exists := l.items[key]
+	if !exists {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruItem[V]).value, true
+}
+
+// adds or replaces a value, returning the items evicted to make room for it
+func (l *lruList[V]) add(key string, value V, size int64) []*lruItem[V] {
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem[V]{key, value, size})
+	l.size += size
+
+	var evicted []*lruItem[V]
+	for l.size > l.maxSize && l.order.Len() > 1 {
+		item := l.order.Back().Value.(*lruItem[V])
+		l.remove(item.key)
+		evicted = append(evicted, item)
+	}
+	return evicted
+}
+
+func (l *lruList[V]) remove(key string) (*lruItem[V], bool) {
+	element, exists := l.items[key]
+	if !exists {
+		return nil, false
+	}
+	item := element.Value.(*lruItem[V])
+	l.order.Remove(element)
+	delete(l.items, key)
+	l.size -= item.size
+	return item, true
+}
+
+// calls fn with every item, from most to least recently used
+func (l *lruList[V]) each(fn func(*lruItem[V])) {
+	for element := l.order.Front(); element != nil; element = element.Next() {
+		fn(element.Value.(*lruItem[V]))
+	}
+}
+
+// counts the stored variants of each primary key so the cache can forget the headers a URL varies on once none of
+// its variants are left. It is not safe for concurrent use
+type variantCounter struct {
+	counts map[string]int
+	// called with the primary key whose last variant was removed, if set
+	onEmpty func(primaryKey string)
+}
+
+func newVariantCounter() variantCounter {
+	return variantCounter{counts: map[string]int{}}
+}
+
+func (v *variantCounter) add(entry *cacheEntry) {
+	v.counts[entry.PrimaryKey]++
+}
+
+func (v *variantCounter) remove(entry *cacheEntry) {
+	v.counts[entry.PrimaryKey]--
+	if v.counts[entry.PrimaryKey] <= 0 {
+		delete(v.counts, entry.PrimaryKey)
+		if v.onEmpty != nil {
+			v.onEmpty(entry.PrimaryKey)
+		}
+	}
+}
+
+// keeps entries in memory up to a total size
+type memoryStore struct {
+	mu       sync.Mutex
+	lru      *lruList[*cacheEntry]
+	variants variantCounter
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{lru: newLRUList[*cacheEntry](maxSize), variants: newVariantCounter()}
+}
+
+func (s *memoryStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.get(key)
+}
+
+func (s *memoryStore) set(entry *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.lru.has(entry.Key) {
+		s.variants.add(entry)
+	}
+	for _, item := range s.lru.add(entry.Key, entry, entry.size()) {
+		s.variants.remove(item.value)
+	}
+}
+
+func (s *memoryStore) removeWhere(match func(*cacheEntry) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	s.lru.each(func(item *lruItem[*cacheEntry]) {
+		if match(item.value) {
+			keys = append(keys, item.key)
+		}
+	})
+	for _, key := range keys {
+		if item, removed := s.lru.remove(key); removed {
+			s.variants.remove(item.value)
+		}
+	}
+	return len(keys)
+}
+
+func (s *memoryStore) each(fn func(*cacheEntry)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.each(func(item *lruItem[*cacheEntry]) {
+		fn(item.value)
+	})
+}
+
+func (s *memoryStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lru.items), s.lru.size
+}
+
+// keeps entries in files in a directory up to a total size. The entries' metadata is indexed in memory while their
+// bodies are only read from disk when needed
+type diskStore struct {
+	dir string
+
+	mu sync.Mutex
+	// entries without their body
+	lru      *lruList[*cacheEntry]
+	variants variantCounter
+	// incremented whenever entries are removed so writes started before then can be dropped
+	generation uint64
+}
+
+// opens the store in dir, creating the directory if needed and indexing any entries left from a previous run
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory '%s': %s", dir, err)
+	}
+	s := &diskStore{dir: dir, lru: newLRUList[*cacheEntry](maxSize), variants: newVariantCounter()}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory '%s': %s", dir, err)
+	}
+
+	type storedFile struct {
+		entry   *cacheEntry
+		size    int64
+		modTime time.Time
+	}
+	var stored []storedFile
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(file.Name()) != ".entry" {
+			continue
+		}
+		entry, err := s.read(filepath.Join(dir, file.Name()))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("removing unreadable cache file '%s'", file.Name()), "err", err)
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		entry.Body = nil
+		stored = append(stored, storedFile{entry, info.Size(), info.ModTime()})
+	}
+
+	// add the oldest files first so they are the first to be evicted
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].modTime.Before(stored[j].modTime)
+	})
+	for _, file := range stored {
+		s.add(file.entry, file.size)
+	}
+
+	return s, nil
+}
+
+// returns the file an entry is stored in
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".entry")
+}
+
+func (s *diskStore) read(path string) (*cacheEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entry := cacheEntry{hits: &atomic.Int64{}}
+	if err := gob.NewDecoder(file).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// indexes an entry whose file is size bytes, evicting older entries to make room for it. It must be called with s.mu
+// held
+func (s *diskStore) add(meta *cacheEntry, size int64) {
+	if !s.lru.has(meta.Key) {
+		s.variants.add(meta)
+	}
+	s.evict(s.lru.add(meta.Key, meta, size))
+}
+
+// deletes the files of evicted entries. It must be called with s.mu held
+func (s *diskStore) evict(items []*lruItem[*cacheEntry]) {
+	for _, item := range items {
+		os.Remove(s.path(item.key))
+		s.variants.remove(item.value)
+	}
+}
+
+func (s *diskStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	meta, exists := s.lru.get(key)
+	s.mu.Unlock()
+	if !exists {
+		return nil, false
+	}
+
+	entry, err := s.read(s.path(key))
+	if err != nil {
+		s.mu.Lock()
+		if item, removed := s.lru.remove(key); removed {
+			s.variants.remove(item.value)
+		}
+		s.mu.Unlock()
+		return nil, false
+	}
+	entry.hits = meta.hits
+	return entry, true
+}
+
+func (s *diskStore) set(entry *cacheEntry) {
+	s.write(entry, s.currentGeneration())
+}
+
+func (s *diskStore) currentGeneration() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// stores an entry unless entries have been removed since generation, in which case the entry may be one that was
+// meant to be removed
+func (s *diskStore) write(entry *cacheEntry, generation uint64) {
+	// write to a temporary file first so readers never see a partially written entry
+	file, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		slog.Warn("failed to write cache entry to disk", "err", err)
+		return
+	}
+	err = gob.NewEncoder(file).Encode(entry)
+	info, statErr := file.Stat()
+	file.Close()
+	if err == nil {
+		err = statErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(entry.Key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		slog.Warn("failed to write cache entry to disk", "err", err)
+		return
+	}
+
+	meta := *entry
+	meta.Body = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		os.Remove(s.path(entry.Key))
+		// the cache may have recorded what the entry varies on before it was dropped
+		if s.variants.counts[entry.PrimaryKey] == 0 && s.variants.onEmpty != nil {
+			s.variants.onEmpty(entry.PrimaryKey)
+		}
+		return
+	}
+	s.add(&meta, info.Size())
+}
+
+func (s *diskStore) removeWhere(match func(*cacheEntry) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []*lruItem[*cacheEntry]
+	s.lru.each(func(item *lruItem[*cacheEntry]) {
+		if match(item.value) {
+			removed = append(removed, item)
+		}
+	})
+	for _, item := range removed {
+		s.lru.remove(item.key)
+	}
+	s.evict(removed)
+	s.generation++
+	return len(removed)
+}
+
+func (s *diskStore) each(fn func(*cacheEntry)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.each(func(item *lruItem[*cacheEntry]) {
+		fn(item.value)
+	})
+}
+
+func (s *diskStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lru.items), s.lru.size
+}
+
+// keeps recently used entries in memory in front of a larger store on disk. Entries evicted from memory are still
+// served from disk
+type tieredStore struct {
+	memory *memoryStore
+	disk   *diskStore
+}
+
+func (s *tieredStore) get(key string) (*cacheEntry, bool) {
+	if entry, found := s.memory.get(key); found {
+		return entry, true
+	}
+	entry, found := s.disk.get(key)
+	if found {
+		s.memory.set(entry)
+	}
+	return entry, found
+}
+
+func (s *tieredStore) set(entry *cacheEntry) {
+	s.memory.set(entry)
+	// writing to disk happens in the background so it doesn't hold up the response
+	go s.disk.write(entry, s.disk.currentGeneration())
+}
+
+func (s *tieredStore) removeWhere(match func(*cacheEntry) bool) int {
+	s.memory.removeWhere(match)
+	return s.disk.removeWhere(match)
+}
+
+// lists the entries on disk, which include every entry held in memory
+func (s *tieredStore) each(fn func(*cacheEntry)) {
+	s.disk.each(fn)
+}
+
+func (s *tieredStore) stats() (int, int64) {
+	return s.disk.stats()
+}
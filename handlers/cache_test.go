@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/middleware"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{"s-maxage wins over max-age", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		{"no-cache is never fresh", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{"expires", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, time.Hour},
+		{"invalid expires has already expired", http.Header{"Expires": {"0"}}, 0},
+		{"heuristic from last-modified", http.Header{
+			"Date":          {now.Format(http.TimeFormat)},
+			"Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)},
+		}, time.Hour},
+		{"heuristic is capped", http.Header{
+			"Date":          {now.Format(http.TimeFormat)},
+			"Last-Modified": {now.Add(-1000 * time.Hour).Format(http.TimeFormat)},
+		}, maxHeuristicLifetime},
+		{"nothing to go on", http.Header{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := freshnessLifetime(tt.header, now); got != tt.want {
+				t.Errorf("lifetime = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheEntryDecide(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		response string
+		age      time.Duration
+		request  string
+		want     cacheDecision
+	}{
+		{"fresh", "max-age=60", 30 * time.Second, "", cacheUseStored},
+		{"stale", "max-age=60", 90 * time.Second, "", cacheRevalidate},
+		{"stale while revalidating", "max-age=60, stale-while-revalidate=60", 90 * time.Second, "", cacheUseStale},
+		{"past stale-while-revalidate", "max-age=60, stale-while-revalidate=60", 3 * time.Minute, "", cacheRevalidate},
+		{"must-revalidate ignores stale-while-revalidate", "max-age=60, must-revalidate, stale-while-revalidate=60", 90 * time.Second, "", cacheRevalidate},
+		{"request no-cache", "max-age=60", 0, "no-cache", cacheRevalidate},
+		{"request max-age", "max-age=60", 30 * time.Second, "max-age=10", cacheRevalidate},
+		{"request min-fresh", "max-age=60", 30 * time.Second, "min-fresh=40", cacheRevalidate},
+		{"request max-stale", "max-age=60", 90 * time.Second, "max-stale=60", cacheUseStored},
+		{"request max-stale without a limit", "max-age=60", time.Hour, "max-stale", cacheUseStored},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Cache-Control": {tt.response}}
+			responseTime := now.Add(-tt.age)
+			entry := newCacheEntry("key", "key", "url", http.StatusOK, header, nil, responseTime, responseTime)
+
+			reqCC := parseCacheControl(http.Header{"Cache-Control": {tt.request}})
+			if got := entry.decide(reqCC, now); got != tt.want {
+				t.Errorf("decision = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseStorable(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		authorization bool
+		status        int
+		header        http.Header
+		want          bool
+	}{
+		{"explicit freshness", http.MethodGet, false, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"heuristically cacheable", http.MethodGet, false, http.StatusOK, http.Header{}, true},
+		{"not heuristically cacheable", http.MethodGet, false, http.StatusCreated, http.Header{}, false},
+		{"HEAD", http.MethodHead, false, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"no-store", http.MethodGet, false, http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"private", http.MethodGet, false, http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"vary on everything", http.MethodGet, false, http.StatusOK, http.Header{"Vary": {"*"}}, false},
+		{"sets a cookie", http.MethodGet, false, http.StatusOK, http.Header{"Set-Cookie": {"a=b"}}, false},
+		{"partial content", http.MethodGet, false, http.StatusPartialContent, http.Header{}, false},
+		{"authorized", http.MethodGet, true, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorized and public", http.MethodGet, true, http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.authorization {
+				r.Header.Set("Authorization", "Bearer token")
+			}
+			if got := responseStorable(r, tt.status, tt.header); got != tt.want {
+				t.Errorf("storable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	}, map[string]any{"cache": map[string]any{}})
+
+	tests := []struct {
+		language   string
+		wantStatus string
+	}{
+		{"en", cacheMiss},
+		{"fr", cacheMiss},
+		{"en", cacheHit},
+		{"fr", cacheHit},
+		{"", cacheMiss},
+		{"", cacheHit},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		if tt.language != "" {
+			r.Header.Set("Accept-Language", tt.language)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		if got := w.Header().Get(cacheStatusHeader); got != tt.wantStatus {
+			t.Errorf("request %d (%q): cache status = %s, want %s", i, tt.language, got, tt.wantStatus)
+		}
+		if w.Body.String() != tt.language {
+			t.Errorf("request %d (%q): body = %q", i, tt.language, w.Body.String())
+		}
+	}
+}
+
+func TestResponseCacheForgetsVaryOfRemovedEntries(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache map[string]any
+	}{
+		{"memory", map[string]any{"maxsize": 2048, "maxentrysize": 1024}},
+		{"disk", map[string]any{"maxsize": 2048, "maxentrysize": 1024, "diskpath": t.TempDir(), "diskmaxsize": 4096}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Language")
+				w.Write(make([]byte, 512))
+			}, map[string]any{"cache": tt.cache})
+			cache := proxy.cache
+
+			for i := 0; i < 20; i++ {
+				proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/page/%d", i), nil))
+			}
+
+			// entries are written to disk in the background
+			varies := func() int {
+				cache.mu.Lock()
+				defer cache.mu.Unlock()
+				return len(cache.varies)
+			}
+			deadline := time.Now().Add(time.Second)
+			for {
+				entries, _ := cache.store.stats()
+				if varies() == entries {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("cache remembers what %d URLs vary on after eviction, but only %d are stored", varies(), entries)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			cache.store.removeWhere(func(*cacheEntry) bool { return true })
+			if n := varies(); n != 0 {
+				t.Errorf("cache remembers what %d URLs vary on after they were purged", n)
+			}
+		})
+	}
+}
+
+func TestResponseCacheAppliesHeaderRulesPerRequest(t *testing.T) {
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}, map[string]any{
+		"cache": map[string]any{},
+		"headers": map[string]any{
+			"response": map[string]any{"set": map[string]any{"x-request-id": "{request_id}"}},
+		},
+	})
+
+	for i, id := range []string{"first", "second"} {
+		ctx := context.WithValue(context.Background(), chimiddleware.RequestIDKey, id)
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		if got := w.Header().Get("X-Request-Id"); got != id {
+			t.Errorf("request %d: X-Request-Id = %q, want %q", i, got, id)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	entry, found := proxy.cache.lookup(r, proxy.cache.keys.primaryKey(r))
+	if !found {
+		t.Fatal("response wasn't stored")
+	}
+	if entry.Header.Get("X-Request-Id") != "" {
+		t.Error("header rules were stored with the response")
+	}
+}
+
+// auth removes the credentials before the request reaches the cache, which must still treat it as authorized
+func TestResponseCacheSkipsAuthenticatedRequests(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(tokenFile, []byte("alice:alice-token\nbob:bob-token\n"), 0o600)
+	auth, err := middleware.NewAuthenticator(t.Context(), config.NewTable(map[string]any{
+		"type":       "apiKey",
+		"tokenfile":  tokenFile,
+		"userheader": "X-User",
+	}), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantStatus   []string
+	}{
+		{"per-user response", "max-age=60", []string{cacheMiss, cacheMiss}},
+		{"public response", "public, max-age=60", []string{cacheMiss, cacheHit}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				fmt.Fprint(w, r.Header.Get("X-User"))
+			}, map[string]any{"cache": map[string]any{}})
+			handler := auth.Middleware(proxy)
+
+			for i, token := range []string{"alice-token", "bob-token"} {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("X-API-Key", token)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if got := w.Header().Get(cacheStatusHeader); got != tt.wantStatus[i] {
+					t.Errorf("request %d: cache status = %s, want %s", i, got, tt.wantStatus[i])
+				}
+			}
+		})
+	}
+}
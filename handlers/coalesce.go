@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// how long a URL whose response can't be cached is sent straight to the upstream instead of coalescing requests
+// for it, so requests for it aren't held up waiting on each other
+const uncacheableTTL = 30 * time.Second
+
+// the number of uncacheable URLs remembered before expired ones are cleared out
+const maxUncacheable = 1024
+
+// a fetch from the upstream that identical requests arriving while it runs wait on
+type inflightFetch struct {
+	done chan struct{}
+}
+
+// returns the key identifying requests that can share a fetch. Requests only share a fetch if they match the same
+// variant of the most recently stored response
+func (c *responseCache) flightKey(r *http.Request, primaryKey string) string {
+	c.mu.Lock()
+	vary := c.varies[primaryKey]
+	c.mu.Unlock()
+	return variantKey(primaryKey, vary, r)
+}
+
+// fetches a response from the upstream for a request the cache couldn't answer. When coalescing is enabled only the
+// first of several identical requests is sent to the upstream while the rest wait for its response to be stored and
+// are answered from the cache. If the response couldn't be stored, or it takes longer than the wait timeout, each
+// waiting request is sent to the upstream itself
+func (c *responseCache) fetchCoalesced(w http.ResponseWriter, r *http.Request, forward http.HandlerFunc, primaryKey string, stored *cacheEntry) {
+	if !c.coalesce {
+		c.misses.Add(1)
+		c.fetch(w, r, forward, primaryKey, stored)
+		return
+	}
+
+	key := c.flightKey(r, primaryKey)
+
+	c.mu.Lock()
+	if until, exists := c.uncacheable[key]; exists && time.Now().Before(until) {
+		c.mu.Unlock()
+		c.misses.Add(1)
+		c.fetch(w, r, forward, primaryKey, stored)
+		return
+	}
+
+	flight, waiting := c.inflight[key]
+	// only a GET can fill the cache, so a HEAD request either waits on a GET or goes to the upstream on its own
+	if !waiting && r.Method == http.MethodGet {
+		flight = &inflightFetch{done: make(chan struct{})}
+		c.inflight[key] = flight
+	}
+	c.mu.Unlock()
+
+	if !waiting {
+		c.misses.Add(1)
+		if flight == nil {
+			c.fetch(w, r, forward, primaryKey, stored)
+			return
+		}
+		c.lead(w, r, forward, primaryKey, stored, key, flight)
+		return
+	}
+
+	timer := time.NewTimer(c.coalesceTimeout)
+	defer timer.Stop()
+	select {
+	case <-flight.done:
+	case <-timer.C:
+		slog.Debug(fmt.Sprintf("service '%s' timed out waiting for a coalesced request to %s", c.name, r.URL.Path))
+	case <-r.Context().Done():
+		return
+	}
+
+	if entry, found := c.lookup(r, primaryKey); found && entry.decide(requestCacheControl(r), time.Now()) != cacheRevalidate {
+		c.coalesced.Add(1)
+		c.write(w, r, entry, cacheHit)
+		return
+	}
+
+	c.misses.Add(1)
+	c.fetch(w, r, forward, primaryKey, stored)
+}
+
+// sends the request that others are waiting on to the upstream, waking them once its response has been stored or
+// turned out not to be. Only a response that can never be stored stops requests for the URL from being coalesced,
+// not one that failed or was cut short
+func (c *responseCache) lead(w http.ResponseWriter, r *http.Request, forward http.HandlerFunc, primaryKey string, stored *cacheEntry, key string, flight *inflightFetch) {
+	cached, uncacheable := false, false
+	// deferred so waiting requests are released even if the response is aborted part way through
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		if cached {
+			delete(c.uncacheable, key)
+		} else if uncacheable {
+			now := time.Now()
+			if len(c.uncacheable) >= maxUncacheable {
+				c.pruneUncacheable(now)
+			}
+			c.uncacheable[key] = now.Add(uncacheableTTL)
+		}
+		c.mu.Unlock()
+		close(flight.done)
+	}()
+
+	cached, uncacheable = c.fetch(w, r, forward, primaryKey, stored)
+}
+
+// removes expired entries from the set of uncacheable URLs. It must be called with c.mu held
+func (c *responseCache) pruneUncacheable(now time.Time) {
+	for key, until := range c.uncacheable {
+		if now.After(until) {
+			delete(c.uncacheable, key)
+		}
+	}
+}
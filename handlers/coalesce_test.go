@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheCoalescesMisses(t *testing.T) {
+	var hits atomic.Int64
+	release := make(chan struct{})
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}, map[string]any{"cache": map[string]any{"coalesce": true}})
+
+	var wg sync.WaitGroup
+	codes := make([]string, 10)
+	send := func(i int) {
+		wg.Go(func() {
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/page", nil))
+			if w.Body.String() != "ok" {
+				t.Errorf("request %d got %q", i, w.Body.String())
+			}
+			codes[i] = w.Header().Get(cacheStatusHeader)
+		})
+	}
+
+	// the first request leads while the rest arrive during its fetch
+	send(0)
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < len(codes); i++ {
+		send(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+	if n := proxy.cache.coalesced.Load(); n != int64(len(codes)-1) {
+		t.Errorf("%d requests were coalesced, want %d", n, len(codes)-1)
+	}
+	if codes[0] != cacheMiss {
+		t.Errorf("leading request cache status = %s, want %s", codes[0], cacheMiss)
+	}
+}
+
+// the status and Cache-Control of a response sent by a test upstream
+type upstreamAnswer struct {
+	status       int
+	cacheControl string
+}
+
+func TestResponseCacheMarksUncacheableURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		// the upstream's answer to each request in turn
+		responses []upstreamAnswer
+		want      bool
+	}{
+		{"stored response", []upstreamAnswer{{200, "max-age=60"}}, false},
+		{"no-store response", []upstreamAnswer{{200, "no-store"}}, true},
+		{"private response", []upstreamAnswer{{200, "private, max-age=60"}}, true},
+		{"upstream error", []upstreamAnswer{{502, ""}}, false},
+		{"stale response served for an error", []upstreamAnswer{{200, "max-age=0, stale-if-error=60"}, {500, ""}}, false},
+		{"stored after an error", []upstreamAnswer{{503, ""}, {200, "max-age=60"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int64
+			proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				response := tt.responses[hits.Add(1)-1]
+				w.Header().Set("Cache-Control", response.cacheControl)
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(response.status)
+			}, map[string]any{"cache": map[string]any{"coalesce": true}})
+
+			for range tt.responses {
+				proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+			}
+
+			proxy.cache.mu.Lock()
+			marked := len(proxy.cache.uncacheable) > 0
+			proxy.cache.mu.Unlock()
+			if marked != tt.want {
+				t.Errorf("URL marked uncacheable = %v, want %v", marked, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"html/template"
 	"net/http"
 	"strings"
-	"text/template"
+	"sync"
 )
 
 const debugHandlerTemplate string = `<!DOCTYPE html>
@@ -16,21 +17,66 @@ const debugHandlerTemplate string = `<!DOCTYPE html>
 </head>
 <body>
     <a href="/debug/log">Server Logs</a>
+    <pre>{{ . }}</pre>
 </body>
 </html>
 `
 
+// a service, or something in front of it, that reports its internal state on the debug endpoint
+type DebugInfoProvider interface {
+	DebugInfo() map[string]any
+}
+
 // handles debug requests if the server is running in developmentMode
-func DebugHandler(w http.ResponseWriter, r *http.Request) {
+type DebugHandler struct {
+	mu       sync.Mutex
+	services map[string][]DebugInfoProvider
+}
+
+func NewDebugHandler() *DebugHandler {
+	return &DebugHandler{services: map[string][]DebugInfoProvider{}}
+}
+
+// adds the state reported by provider to the debug output of a service. The state of every provider registered for a
+// service is merged together
+func (d *DebugHandler) Register(name string, provider DebugInfoProvider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.services[name] = append(d.services[name], provider)
+}
+
+func (d *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	services := map[string]any{}
+	for name, providers := range d.services {
+		info := map[string]any{}
+		for _, provider := range providers {
+			for key, value := range provider.DebugInfo() {
+				info[key] = value
+			}
+		}
+		services[name] = info
+	}
+	d.mu.Unlock()
+
+	debugInfo := map[string]any{
+		"services": services,
+	}
+
 	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		data, err := json.MarshalIndent(debugInfo, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("Content-Type", "text/html")
 		t := template.Must(template.New("debug").Parse(debugHandlerTemplate))
 
-		t.Execute(w, nil)
+		t.Execute(w, string(data))
 		return
 	}
 
-	debugInfo := map[string]any{}
-
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(debugInfo)
 }
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/middleware"
+)
+
+// expands the placeholders in a header value using information from the request
+func expandHeaderValue(value string, r *http.Request) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+
+	now := time.Now()
+	return strings.NewReplacer(
+		"{client_ip}", middleware.ClientIP(r).String(),
+		"{request_id}", chimiddleware.GetReqID(r.Context()),
+		"{host}", r.Host,
+		"{method}", r.Method,
+		"{path}", r.URL.Path,
+		"{timestamp}", now.Format(time.RFC3339),
+		"{timestamp_unix}", strconv.FormatInt(now.Unix(), 10),
+	).Replace(value)
+}
+
+// a set of changes to make to a group of headers. Headers are removed first, then set and finally added
+type headerOps struct {
+	set    map[string]string
+	add    map[string]string
+	remove []string
+}
+
+func buildHeaderOps(cfg *config.Table) headerOps {
+	return headerOps{
+		set:    cfg.StringMap("set"),
+		add:    cfg.StringMap("add"),
+		remove: cfg.StringSlice("remove"),
+	}
+}
+
+func (o headerOps) empty() bool {
+	return len(o.set) == 0 && len(o.add) == 0 && len(o.remove) == 0
+}
+
+// applies the changes to h, expanding any placeholders using r
+func (o headerOps) apply(h http.Header, r *http.Request) {
+	for _, name := range o.remove {
+		h.Del(name)
+	}
+	for name, value := range o.set {
+		h.Set(name, expandHeaderValue(value, r))
+	}
+	for name, value := range o.add {
+		h.Add(name, expandHeaderValue(value, r))
+	}
+}
+
+// the header changes a service makes to requests before handling them and to responses before returning them
+type headerRules struct {
+	request  headerOps
+	response headerOps
+}
+
+// builds the header rules of a service, returning nil if the service doesn't change any headers
+func buildHeaderRules(cfg *config.Table) (*headerRules, error) {
+	headers := cfg.Table("headers")
+	rules := &headerRules{
+		request:  buildHeaderOps(headers.Table("request")),
+		response: buildHeaderOps(headers.Table("response")),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if rules.request.empty() && rules.response.empty() {
+		return nil, nil
+	}
+	return rules, nil
+}
+
+// wraps w so the response rules are applied just before the response headers are sent
+func (h *headerRules) wrapResponseWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if h.response.empty() {
+		return w
+	}
+	return &headerRulesWriter{ResponseWriter: w, rules: h.response, r: r}
+}
+
+type headerRulesWriter struct {
+	http.ResponseWriter
+	rules       headerOps
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *headerRulesWriter) WriteHeader(code int) {
+	// informational responses are passed through so the rules are applied to the final response
+	if !w.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.wroteHeader = true
+		w.rules.apply(w.Header(), w.r)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRulesWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// lets http.ResponseController reach the underlying writer to flush or hijack it
+func (w *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/grqphical/interchange/config"
+)
+
+func TestHeaderOpsOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		ops     map[string]any
+		initial []string
+		want    []string
+	}{
+		{"set replaces every value", map[string]any{"set": map[string]any{"x-a": "new"}}, []string{"old", "older"}, []string{"new"}},
+		{"add keeps existing values", map[string]any{"add": map[string]any{"x-a": "new"}}, []string{"old"}, []string{"old", "new"}},
+		{"remove", map[string]any{"remove": []any{"X-A"}}, []string{"old"}, nil},
+		{"set after remove", map[string]any{"remove": []any{"x-a"}, "set": map[string]any{"x-a": "new"}}, []string{"old"}, []string{"new"}},
+		{"add after remove", map[string]any{"remove": []any{"x-a"}, "add": map[string]any{"x-a": "new"}}, []string{"old"}, []string{"new"}},
+		{"add after set", map[string]any{"set": map[string]any{"x-a": "set"}, "add": map[string]any{"x-a": "added"}}, []string{"old"}, []string{"set", "added"}},
+		{
+			"remove, then set, then add",
+			map[string]any{"add": map[string]any{"x-a": "added"}, "set": map[string]any{"x-a": "set"}, "remove": []any{"x-a"}},
+			[]string{"old"}, []string{"set", "added"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{"X-A": tt.initial}
+			buildHeaderOps(config.NewTable(tt.ops)).apply(h, httptest.NewRequest(http.MethodGet, "/", nil))
+			if got := h.Values("X-A"); !slices.Equal(got, tt.want) {
+				t.Errorf("X-A = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandHeaderValue(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/orders/42?draft=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r = r.WithContext(context.WithValue(r.Context(), chimiddleware.RequestIDKey, "req-1"))
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"{client_ip}", "192.0.2.1"},
+		{"{request_id}", "req-1"},
+		{"{host}", "example.com"},
+		{"{method} {path}", "POST /orders/42"},
+		{"id={request_id};ip={client_ip}", "id=req-1;ip=192.0.2.1"},
+		{"{unknown}", "{unknown}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := expandHeaderValue(tt.value, r); got != tt.want {
+				t.Errorf("expanded to %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	before := time.Now().Truncate(time.Second)
+	timestamp, err := time.Parse(time.RFC3339, expandHeaderValue("{timestamp}", r))
+	if err != nil || timestamp.Before(before) || timestamp.After(time.Now()) {
+		t.Errorf("{timestamp} expanded to %s (%v), want the current time", timestamp, err)
+	}
+	unix, err := strconv.ParseInt(expandHeaderValue("{timestamp_unix}", r), 10, 64)
+	if err != nil || unix < before.Unix() || unix > time.Now().Unix() {
+		t.Errorf("{timestamp_unix} expanded to %d (%v), want the current time", unix, err)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	var calls atomic.Int32
+	var upstream http.Header
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		upstream = r.Header.Clone()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Server", "upstream")
+		w.Write([]byte("ok"))
+	}, map[string]any{
+		"cache": map[string]any{},
+		"headers": map[string]any{
+			"request": map[string]any{
+				"set":    map[string]any{"x-request-id": "{request_id}"},
+				"remove": []any{"cookie"},
+			},
+			"response": map[string]any{
+				"set":    map[string]any{"x-request-id": "{request_id}"},
+				"add":    map[string]any{"x-client": "{client_ip}"},
+				"remove": []any{"server"},
+			},
+		},
+	})
+
+	// the second and third requests are cache hits, which still get values for the request they answer
+	for i, client := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		id := "req-" + strconv.Itoa(i)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = client + ":1234"
+		r.Header.Set("Cookie", "session=secret")
+		r.Header.Set("X-Request-ID", "from-client")
+		r = r.WithContext(context.WithValue(r.Context(), chimiddleware.RequestIDKey, id))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		if got := w.Header().Get("X-Request-ID"); got != id {
+			t.Errorf("request %d: X-Request-ID = %q, want %q", i, got, id)
+		}
+		if got := w.Header().Values("X-Client"); !slices.Equal(got, []string{client}) {
+			t.Errorf("request %d: X-Client = %q, want %q", i, got, client)
+		}
+		if got := w.Header().Get("Server"); got != "" {
+			t.Errorf("request %d: Server = %q, want it removed", i, got)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream was called %d times, want 1", n)
+	}
+	if got := upstream.Get("X-Request-ID"); got != "req-0" {
+		t.Errorf("upstream got X-Request-ID %q, want %q", got, "req-0")
+	}
+	if got := upstream.Get("Cookie"); got != "" {
+		t.Errorf("upstream got Cookie %q, want it removed", got)
+	}
+}
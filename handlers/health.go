@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// settings for actively polling the upstreams of a service
+type healthCheck struct {
+	// path and query requested from each upstream, relative to the upstream's own path
+	path               *url.URL
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	// inclusive range of status codes that count as healthy
+	minStatus int
+	maxStatus int
+}
+
+// parses a status range such as "200-399" or a single status code
+func parseStatusRange(value string) (int, int, error) {
+	lower, upper, isRange := strings.Cut(value, "-")
+	if !isRange {
+		upper = lower
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(lower))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status range '%s'", value)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(upper))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status range '%s'", value)
+	}
+
+	if min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("invalid status range '%s'", value)
+	}
+
+	return min, max, nil
+}
+
+func buildHealthCheck(cfg *config.Table) (*healthCheck, error) {
+	hc := &healthCheck{
+		interval:           cfg.Duration("interval", 30*time.Second),
+		timeout:            cfg.Duration("timeout", 5*time.Second),
+		healthyThreshold:   cfg.Int("healthyThreshold", 2),
+		unhealthyThreshold: cfg.Int("unhealthyThreshold", 3),
+	}
+	path := cfg.String("path", "/")
+	expectedStatus := cfg.String("expectedStatus", "200-399")
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	hc.path, err = url.Parse(path)
+	if err != nil || hc.path.Scheme != "" || hc.path.Host != "" {
+		return nil, fmt.Errorf("invalid healthCheck path '%s'", path)
+	}
+
+	if hc.interval <= 0 || hc.timeout <= 0 {
+		return nil, fmt.Errorf("healthCheck interval and timeout must be positive")
+	}
+	if hc.healthyThreshold < 1 || hc.unhealthyThreshold < 1 {
+		return nil, fmt.Errorf("healthCheck thresholds must be at least 1")
+	}
+
+	hc.minStatus, hc.maxStatus, err = parseStatusRange(expectedStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	return hc, nil
+}
+
+// sends a single health check request to the upstream, returning an error if it is unhealthy
+func (hc *healthCheck) probe(ctx context.Context, client *http.Client, upstream *Upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	// joined rather than resolved so an upstream served under a path keeps it, with the query added afterwards as
+	// JoinPath would escape it
+	target := upstream.URL.JoinPath(hc.path.Path)
+	target.RawQuery = hc.path.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "interchange-health-check")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode < hc.minStatus || resp.StatusCode > hc.maxStatus {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// polls a single upstream until ctx is cancelled, marking it up or down once enough consecutive checks agree
+func (hc *healthCheck) run(ctx context.Context, client *http.Client, name string, upstream *Upstream) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		err := hc.probe(ctx, client, upstream)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			successes++
+			failures = 0
+			if successes >= hc.healthyThreshold && !upstream.healthy.Load() {
+				upstream.healthy.Store(true)
+				slog.Info(fmt.Sprintf("service '%s' upstream '%s' is back online", name, upstream.URL))
+			}
+		} else {
+			failures++
+			successes = 0
+			if failures >= hc.unhealthyThreshold && upstream.healthy.Load() {
+				upstream.healthy.Store(false)
+				slog.Error(fmt.Sprintf("service '%s' upstream '%s' is offline", name, upstream.URL), "err", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max int
+		wantErr  bool
+	}{
+		{"200-399", 200, 399, false},
+		{"204", 204, 204, false},
+		{" 200 - 299 ", 200, 299, false},
+		{"100-599", 100, 599, false},
+		{"399-200", 0, 0, true},
+		{"99", 0, 0, true},
+		{"200-600", 0, 0, true},
+		{"200-", 0, 0, true},
+		{"-299", 0, 0, true},
+		{"2xx", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			min, max, err := parseStatusRange(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if min != tt.min || max != tt.max {
+				t.Errorf("got %d-%d, want %d-%d", min, max, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBuildHealthCheckErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"zero interval", map[string]any{"interval": "0s"}},
+		{"negative timeout", map[string]any{"timeout": "-1s"}},
+		{"zero threshold", map[string]any{"healthythreshold": 0}},
+		{"invalid expected status", map[string]any{"expectedstatus": "ok"}},
+		{"URL instead of a path", map[string]any{"path": "http://other.example.com/health"}},
+		{"unparsable path", map[string]any{"path": "/%zz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildHealthCheck(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestHealthCheckProbeTarget(t *testing.T) {
+	tests := []struct {
+		path       string
+		targetPath string
+		want       string
+	}{
+		{"/", "", "/"},
+		{"/health", "", "/health"},
+		{"/health?full=1&format=json", "", "/health?full=1&format=json"},
+		{"/health?full=1", "/app", "/app/health?full=1"},
+		{"health", "/app/", "/app/health"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.RequestURI()
+			}))
+			t.Cleanup(server.Close)
+
+			hc, err := buildHealthCheck(config.NewTable(map[string]any{"path": tt.path}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, _ := url.Parse(server.URL + tt.targetPath)
+			if err := hc.probe(t.Context(), server.Client(), &Upstream{URL: target}); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("requested %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	// the status of each probe in turn, and whether the upstream should be healthy once it has been handled
+	steps := []struct {
+		status      int
+		wantHealthy bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusInternalServerError, true},
+		// a success resets the count of failures
+		{http.StatusOK, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusNotFound, true},
+		{http.StatusBadGateway, false},
+		{http.StatusOK, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusNoContent, false},
+		{http.StatusFound, true},
+	}
+
+	probes := make(chan struct{})
+	statuses := make(chan int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case probes <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case status := <-statuses:
+			w.WriteHeader(status)
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	hc, err := buildHealthCheck(config.NewTable(map[string]any{
+		"interval":           "1ms",
+		"healthythreshold":   2,
+		"unhealthythreshold": 3,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := url.Parse(server.URL)
+	upstream := &Upstream{URL: target}
+	upstream.healthy.Store(true)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		hc.run(ctx, server.Client(), "test", upstream)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	<-probes
+	for i, step := range steps {
+		statuses <- step.status
+
+		// the next probe only starts once the result of this one has been recorded
+		<-probes
+		if upstream.Healthy() != step.wantHealthy {
+			t.Fatalf("after probe %d (%d) healthy = %v, want %v", i+1, step.status, upstream.Healthy(), step.wantHealthy)
+		}
+	}
+}
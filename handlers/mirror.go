@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// copies requests to a shadow upstream in the background, discarding its responses
+type mirror struct {
+	name       string
+	target     *url.URL
+	percentage float64
+	timeout    time.Duration
+	bodyLimit  int64
+
+	client *http.Client
+	// limits the number of mirrored requests in flight. Requests are not mirrored while it is full
+	slots chan struct{}
+}
+
+func buildMirror(cfg *config.Table, name string) (*mirror, error) {
+	target := cfg.String("target", "")
+	m := &mirror{
+		name:       name,
+		percentage: cfg.Float("percentage", 100),
+		timeout:    cfg.Duration("timeout", 10*time.Second),
+		bodyLimit:  int64(cfg.Int("bodyLimit", 1<<20)),
+	}
+	maxConcurrent := cfg.Int("maxConcurrent", 16)
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if target == "" {
+		return nil, fmt.Errorf("mirror target not set")
+	}
+	targetURL, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, fmt.Errorf("mirror target '%s' is an invalid URL", target)
+	}
+	m.target = targetURL
+
+	if m.percentage < 0 || m.percentage > 100 {
+		return nil, fmt.Errorf("mirror percentage must be between 0 and 100")
+	}
+	if maxConcurrent < 1 {
+		return nil, fmt.Errorf("mirror maxConcurrent must be at least 1")
+	}
+	if m.timeout <= 0 || m.bodyLimit < 0 {
+		return nil, fmt.Errorf("mirror timeout must be positive and bodyLimit must not be negative")
+	}
+
+	m.slots = make(chan struct{}, maxConcurrent)
+	m.client = &http.Client{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return m, nil
+}
+
+// sends a copy of the request to the mirror if it is sampled and a slot is free. The request's body is copied while
+// the primary upstream reads it and the copy is sent once the whole body has been read, so the primary request isn't
+// held up. Bodies over the limit are not mirrored. paths rewrites the copy's path the same way as the primary request.
+// The returned function must be called once the primary request has finished and gives up on mirroring if its body
+// was never read in full
+func (m *mirror) send(r *http.Request, paths *pathRewriter) func() {
+	if isUpgradeRequest(r) || r.ContentLength > m.bodyLimit {
+		return func() {}
+	}
+	if m.percentage < 100 && rand.Float64()*100 >= m.percentage {
+		return func() {}
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		slog.Debug(fmt.Sprintf("service '%s' skipped mirroring %s %s, too many mirrored requests in flight", m.name, r.Method, r.URL.Path))
+		return func() {}
+	}
+
+	// the mirrored request must outlive the client's request, which may finish first
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.timeout)
+	req := r.Clone(ctx)
+	req.RequestURI = ""
+	paths.rewrite(req.URL)
+	(&httputil.ProxyRequest{Out: req}).SetURL(m.target)
+	req.Header.Set("X-Interchange-Mirror", "1")
+
+	release := func() {
+		cancel()
+		<-m.slots
+	}
+
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		req.Body = http.NoBody
+		go m.do(req, r.URL.Path, release)
+		return func() {}
+	}
+
+	body := &teeBody{
+		ReadCloser: r.Body,
+		limit:      m.bodyLimit,
+		dispatch: func(body []byte) {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			go m.do(req, r.URL.Path, release)
+		},
+		abandon: release,
+	}
+	r.Body = body
+	return func() { body.finish(false) }
+}
+
+// sends a mirrored request and logs how the mirror responded
+func (m *mirror) do(req *http.Request, path string, release func()) {
+	defer release()
+
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("service '%s' failed to mirror %s %s to %s", m.name, req.Method, path, m.target), "err", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	latency := time.Since(start)
+	slog.Info(fmt.Sprintf("service '%s' mirrored %s %s to %s: %d in %s", m.name, req.Method, path, m.target, resp.StatusCode, latency),
+		"status", resp.StatusCode, "latency", latency.String())
+}
+
+// copies a request's body into a buffer of up to limit bytes as it is read. dispatch is called with the copy once the
+// whole body has been read, or abandon if the body was too large or wasn't read to the end
+type teeBody struct {
+	io.ReadCloser
+	limit int64
+
+	dispatch func(body []byte)
+	abandon  func()
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	done     bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.done && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.finishLocked(true)
+	}
+	return n, err
+}
+
+// hands the copy to dispatch if the body was read to the end and fit in the buffer, otherwise calls abandon. Only the
+// first call has any effect
+func (b *teeBody) finish(complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.finishLocked(complete)
+}
+
+func (b *teeBody) finishLocked(complete bool) {
+	if b.done {
+		return
+	}
+	b.done = true
+
+	if complete && !b.overflow {
+		b.dispatch(b.buf.Bytes())
+	} else {
+		b.abandon()
+	}
+}
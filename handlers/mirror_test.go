@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorCopiesBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		chunked    bool
+		wantMirror bool
+	}{
+		{"request without a body", http.MethodGet, "", false, true},
+		{"body under the limit", http.MethodPost, "hello", false, true},
+		{"chunked body under the limit", http.MethodPost, "hello", true, true},
+		{"body over the limit", http.MethodPost, strings.Repeat("x", 64), false, false},
+		{"chunked body over the limit", http.MethodPost, strings.Repeat("x", 64), true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirrored := make(chan string, 1)
+			shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mirrored <- string(body)
+			}))
+			defer shadow.Close()
+
+			proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				w.Write(body)
+			}, map[string]any{
+				"mirror": map[string]any{"target": shadow.URL, "bodylimit": 16},
+			})
+
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			// the primary upstream always gets the whole body, whether or not it is mirrored
+			if w.Body.String() != tt.body {
+				t.Errorf("primary got %q, want %q", w.Body.String(), tt.body)
+			}
+
+			select {
+			case body := <-mirrored:
+				if !tt.wantMirror {
+					t.Fatal("request was mirrored")
+				}
+				if body != tt.body {
+					t.Errorf("mirror got %q, want %q", body, tt.body)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantMirror {
+					t.Fatal("request wasn't mirrored")
+				}
+			}
+
+			// the slot is given back whether or not the request was mirrored
+			deadline := time.Now().Add(time.Second)
+			for len(proxy.mirror.slots) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("mirror slot was never released")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTeeBodyAbandonsUnreadBody(t *testing.T) {
+	var dispatched, abandoned bool
+	body := &teeBody{
+		ReadCloser: io.NopCloser(strings.NewReader("hello")),
+		limit:      16,
+		dispatch:   func([]byte) { dispatched = true },
+		abandon:    func() { abandoned = true },
+	}
+
+	body.Read(make([]byte, 2))
+	body.finish(false)
+	io.ReadAll(body)
+
+	if dispatched || !abandoned {
+		t.Errorf("dispatched = %v, abandoned = %v, want only abandoned", dispatched, abandoned)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// a regex based path rewrite such as `^/v1/(.*)$` -> `/api/$1`
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// rewrites request paths before they are handled by a service. The prefix is stripped first, then the first
+// matching rewrite rule is applied and finally the new prefix is added
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rules       []rewriteRule
+}
+
+// builds the path rewriter of a service, returning nil if the service doesn't rewrite paths
+func buildPathRewriter(cfg *config.Table) (*pathRewriter, error) {
+	p := &pathRewriter{
+		stripPrefix: strings.TrimSuffix(cfg.String("stripPrefix", ""), "/"),
+		addPrefix:   strings.TrimSuffix(cfg.String("addPrefix", ""), "/"),
+	}
+
+	for _, rule := range cfg.Tables("rewrite") {
+		pattern := rule.String("pattern", "")
+		replacement := rule.String("replacement", "")
+		if rule.Err() != nil {
+			break
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern '%s': %s", pattern, err)
+		}
+		p.rules = append(p.rules, rewriteRule{re, replacement})
+	}
+
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.stripPrefix == "" && p.addPrefix == "" && len(p.rules) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// returns the rewritten form of the given path
+func (p *pathRewriter) rewritePath(path string) string {
+	if p.stripPrefix != "" {
+		// only strip whole segments so a prefix of /api doesn't turn /apis into s
+		if path == p.stripPrefix {
+			path = "/"
+		} else if strings.HasPrefix(path, p.stripPrefix+"/") {
+			path = strings.TrimPrefix(path, p.stripPrefix)
+		}
+	}
+
+	for _, rule := range p.rules {
+		if rule.pattern.MatchString(path) {
+			path = rule.pattern.ReplaceAllString(path, rule.replacement)
+			break
+		}
+	}
+
+	if p.addPrefix != "" {
+		path = p.addPrefix + path
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// rewrites the path of u in place
+func (p *pathRewriter) rewrite(u *url.URL) {
+	if p == nil {
+		return
+	}
+
+	u.Path = p.rewritePath(u.Path)
+	// the raw path no longer matches so let url re-encode the new path
+	u.RawPath = ""
+}
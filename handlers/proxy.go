@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,50 +11,356 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"time"
 
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/middleware"
 	"github.com/grqphical/interchange/templates"
 )
 
+var (
+	// returned when every upstream of a service is down
+	errNoUpstream = errors.New("no upstream available")
+	// returned when every healthy upstream of a service has an open circuit breaker
+	errCircuitOpen = errors.New("circuit breaker open")
+)
+
+// key used to store the proxyState of a request in its context
+type proxyStateKey struct{}
+
+// per request information shared between the hooks of the reverse proxy
+type proxyState struct {
+	// the incoming request
+	in *http.Request
+
+	// the upstreams of the split group picked for the request
+	pool *upstreamPool
+
+	// nil if no upstream was available, in which case err says why
+	upstream *Upstream
+	err      error
+	// whether the outcome of sending the request to upstream has been reported to its circuit breaker
+	reported bool
+
+	// the outgoing URL before it was pointed at an upstream, used to point retries at a different upstream
+	outURL *url.URL
+}
+
+// a reverse proxy service that balances requests between one or more upstreams
+type ReverseProxyService struct {
+	name        string
+	proxy       *httputil.ReverseProxy
+	split       *trafficSplit
+	healthCheck *healthCheck
+
+	// nil unless the service has a circuit breaker configured
+	breakerSettings *breakerSettings
+	retry           *retryPolicy
+
+	transport *http.Transport
+	// deadline for the whole request, including retries. Zero means no deadline
+	timeout time.Duration
+
+	forwardErrors bool
+	upgrades      *upgradeSettings
+	paths         *pathRewriter
+	headers       *headerRules
+	mirror        *mirror
+	// nil unless the service has caching enabled
+	cache *responseCache
+}
+
+// starts polling the upstreams of the service if it has health checks configured. Polling stops once ctx is
+// cancelled
+func (s *ReverseProxyService) StartHealthChecks(ctx context.Context) {
+	if s.healthCheck == nil {
+		return
+	}
+
+	client := &http.Client{
+		Transport: s.transport,
+		// a redirect is an answer from the upstream, not something that needs following
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, upstream := range s.split.upstreams() {
+		go s.healthCheck.run(ctx, client, s.name, upstream)
+	}
+}
+
+// returns the state of the service's split groups and upstreams for the debug endpoint
+func (s *ReverseProxyService) DebugInfo() map[string]any {
+	groups := map[string]any{}
+	for _, group := range s.split.groups {
+		upstreams := make([]map[string]any, len(group.pool.upstreams))
+		for i, upstream := range group.pool.upstreams {
+			info := map[string]any{
+				"url":            upstream.URL.String(),
+				"healthy":        upstream.Healthy(),
+				"activeRequests": upstream.ActiveRequests(),
+			}
+			if upstream.breaker != nil {
+				info["circuitBreaker"] = upstream.breaker.currentState().String()
+			}
+			upstreams[i] = info
+		}
+
+		groups[group.name] = map[string]any{
+			"weight":    group.weight,
+			"requests":  group.requests.Load(),
+			"upstreams": upstreams,
+		}
+	}
+
+	info := map[string]any{
+		"mode":   "reverseProxy",
+		"groups": groups,
+	}
+	if s.cache != nil {
+		info["cache"] = s.cache.debugInfo()
+	}
+	return info
+}
+
+func (s *ReverseProxyService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the response rules are applied as the response is sent rather than to the upstream's response, so responses
+	// served from the cache get values such as {request_id} for the request they answer
+	if s.headers != nil {
+		w = s.headers.wrapResponseWriter(w, r)
+	}
+
+	if isUpgradeRequest(r) {
+		if !s.upgrades.acquire() {
+			w.Header().Set("Retry-After", "1")
+			templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		defer s.upgrades.release()
+	}
+
+	if s.mirror != nil {
+		// the mirror is told once the request is done so it can give up on a body the upstream never read
+		defer s.mirror.send(r, s.paths)()
+	}
+
+	if s.cache != nil {
+		s.cache.serve(w, r, s.forward)
+		return
+	}
+	s.forward(w, r)
+}
+
+// sends the request to an upstream through the reverse proxy
+func (s *ReverseProxyService) forward(w http.ResponseWriter, r *http.Request) {
+	state := &proxyState{}
+	ctx := context.WithValue(r.Context(), proxyStateKey{}, state)
+	// upgraded connections live for as long as the client keeps them open so the deadline doesn't apply to them
+	if s.timeout > 0 && !isUpgradeRequest(r) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+
+	s.proxy.ServeHTTP(w, r)
+
+	if state.upstream != nil {
+		state.upstream.release(state.reported)
+	}
+}
+
+// picks an upstream for the request and points the outgoing request at it
+func (s *ReverseProxyService) rewrite(r *httputil.ProxyRequest) {
+	state := r.In.Context().Value(proxyStateKey{}).(*proxyState)
+	state.in = r.In
+
+	group := s.split.pick(r.In)
+	state.pool = group.pool
+
+	upstream, err := group.pool.next(r.In)
+	if err != nil {
+		state.err = err
+		return
+	}
+	state.upstream = upstream
+
+	s.paths.rewrite(r.Out.URL)
+	outURL := *r.Out.URL
+	state.outURL = &outURL
+	r.SetURL(upstream.URL)
+
+	r.SetXForwarded()
+	// the client and the trusted proxies the request came through are passed on, while anything an untrusted client
+	// claims about itself is dropped
+	r.Out.Header.Set("X-Forwarded-For", middleware.ForwardedFor(r.In))
+	if middleware.FromTrustedProxy(r.In) {
+		for _, header := range []string{"X-Forwarded-Proto", "X-Forwarded-Host"} {
+			if value := r.In.Header.Get(header); value != "" {
+				r.Out.Header.Set(header, value)
+			}
+		}
+	}
+
+	r.Out.Header.Set("Via", fmt.Sprintf("%s interchange", r.In.Proto))
+
+	if s.headers != nil {
+		s.headers.request.apply(r.Out.Header, r.In)
+	}
+}
+
+// adjusts the upstream's response before it is sent to the client
+func (s *ReverseProxyService) modifyResponse(r *http.Response) error {
+	state := r.Request.Context().Value(proxyStateKey{}).(*proxyState)
+	if state.pool.sticky != nil && len(state.pool.upstreams) > 1 {
+		state.pool.sticky.issue(r.Request, r, state.upstream)
+	}
+
+	// the body of a protocol switch is the upstream connection itself so it must be passed through untouched
+	if r.StatusCode == http.StatusSwitchingProtocols {
+		if conn, ok := r.Body.(io.ReadWriteCloser); ok && s.upgrades.idleTimeout > 0 {
+			r.Body = newIdleTimeoutConn(conn, s.upgrades.idleTimeout)
+		}
+		return nil
+	}
+
+	if r.StatusCode >= 400 && !s.forwardErrors {
+		r.Body.Close()
+		var buf bytes.Buffer
+		templates.WriteError(&buf, r.StatusCode, http.StatusText(r.StatusCode))
+		r.Body = io.NopCloser(&buf)
+		r.Header.Set("Content-Type", "text/html")
+		r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	}
+	return nil
+}
+
+// writes the error page for requests that could not be proxied
+func (s *ReverseProxyService) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errNoUpstream):
+		slog.Error(fmt.Sprintf("service '%s' has no healthy upstreams", s.name))
+		templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+	case errors.Is(err, errCircuitOpen):
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.breakerSettings.cooldown.Seconds())))
+		templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+	case errors.Is(err, context.DeadlineExceeded):
+		slog.Error(fmt.Sprintf("service '%s' timed out waiting for upstream", s.name), "err", err)
+		templates.WriteError(w, http.StatusGatewayTimeout, "Gateway Timeout")
+	case errors.Is(err, context.Canceled):
+		// the client went away so there is nobody to send an error page to
+	default:
+		slog.Error(fmt.Sprintf("service '%s' failed to proxy request", s.name), "err", err)
+		templates.WriteError(w, http.StatusBadGateway, "Bad Gateway")
+	}
+}
+
 // creates a new reverse proxy service based on the given user configuration
-func BuildReverseProxyService(service map[string]any, name string) (*httputil.ReverseProxy, bool) {
-	target, exists := service["target"]
-	if !exists {
-		slog.Error("ConfigurationError", "err", fmt.Sprintf("target not set on service '%s'", name))
+func BuildReverseProxyService(service map[string]any, name string) (*ReverseProxyService, bool) {
+	cfg := config.NewTable(service)
+
+	split, err := buildTrafficSplit(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
 		return nil, false
 	}
 
-	targetURL, err := url.ParseRequestURI(target.(string))
+	forwardErrors := cfg.Bool("forwardErrors", false)
+	timeout := cfg.Duration("timeout", 0)
+	flushInterval := parseFlushInterval(cfg)
+	if err := cfg.Err(); err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
+	}
+
+	transport, err := buildHTTPTransport(cfg.Table("transport"))
 	if err != nil {
-		slog.Error("ConfigurationError", "err", fmt.Sprintf("target is invalid URL on service '%s'", name))
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
 		return nil, false
 	}
 
-	proxy := &httputil.ReverseProxy{
-		Rewrite: func(r *httputil.ProxyRequest) {
-			r.SetURL(targetURL)
+	s := &ReverseProxyService{
+		name:      name,
+		split:     split,
+		transport: transport,
+		timeout:   timeout,
 
-			r.SetXForwarded()
+		forwardErrors: forwardErrors,
+	}
 
-			r.Out.Header.Set("Via", fmt.Sprintf("%s interchange", r.In.Proto))
-		},
+	s.upgrades, err = buildUpgradeSettings(cfg.Table("websocket"))
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
 	}
 
-	forwardErrors, exists := service["forwarderrors"]
-	if !exists {
-		forwardErrors = false
+	s.paths, err = buildPathRewriter(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
+	}
+
+	s.headers, err = buildHeaderRules(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
 	}
 
-	proxy.ModifyResponse = func(r *http.Response) error {
-		if r.StatusCode >= 400 && !forwardErrors.(bool) {
-			r.Body.Close()
-			var buf bytes.Buffer
-			templates.WriteError(&buf, r.StatusCode, http.StatusText(r.StatusCode))
-			r.Body = io.NopCloser(&buf)
-			r.Header.Set("Content-Type", "text/html")
-			r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	if cfg.Has("mirror") {
+		s.mirror, err = buildMirror(cfg.Table("mirror"), name)
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			return nil, false
 		}
-		return nil
 	}
 
-	return proxy, true
+	if cfg.Has("cache") {
+		s.cache, err = buildResponseCache(cfg.Table("cache"), name)
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			return nil, false
+		}
+	}
+
+	if cfg.Has("healthCheck") {
+		s.healthCheck, err = buildHealthCheck(cfg.Table("healthCheck"))
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			return nil, false
+		}
+	}
+
+	if cfg.Has("circuitBreaker") {
+		s.breakerSettings, err = buildBreakerSettings(cfg.Table("circuitBreaker"))
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			return nil, false
+		}
+
+		for _, upstream := range split.upstreams() {
+			upstream.breaker = newCircuitBreaker(s.breakerSettings, fmt.Sprintf("service '%s' upstream '%s'", name, upstream.URL))
+		}
+	}
+
+	if cfg.Has("retry") {
+		s.retry, err = buildRetryPolicy(cfg.Table("retry"))
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			return nil, false
+		}
+	}
+
+	s.proxy = &httputil.ReverseProxy{
+		Rewrite: s.rewrite,
+		Transport: &upstreamTransport{
+			name:  name,
+			base:  transport,
+			retry: s.retry,
+		},
+		ModifyResponse: s.modifyResponse,
+		ErrorHandler:   s.handleError,
+		FlushInterval:  flushInterval,
+	}
+
+	return s, true
 }
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// builds a reverse proxy service routed at "/" from the rest of its configuration. If handler isn't nil it is
+// started as the service's target
+func newTestProxy(t *testing.T, handler http.HandlerFunc, service map[string]any) *ReverseProxyService {
+	t.Helper()
+	if handler != nil {
+		upstream := httptest.NewServer(handler)
+		t.Cleanup(upstream.Close)
+		service["target"] = upstream.URL
+	}
+	service["mode"] = "reverseProxy"
+	service["route"] = "/"
+
+	proxy, ok := BuildReverseProxyService(service, "test")
+	if !ok {
+		t.Fatal("failed to build the service")
+	}
+	return proxy
+}
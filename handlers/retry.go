@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// settings controlling when and how failed requests to a service's upstreams are retried
+type retryPolicy struct {
+	// total number of attempts, including the first one
+	attempts      int
+	perTryTimeout time.Duration
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	methods       map[string]bool
+	statusCodes   map[int]bool
+
+	// largest request body that will be buffered so it can be replayed. Requests with larger bodies are only
+	// attempted once
+	bufferLimit int64
+}
+
+func buildRetryPolicy(cfg *config.Table) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		attempts:      cfg.Int("attempts", 3),
+		perTryTimeout: cfg.Duration("perTryTimeout", 0),
+		backoff:       cfg.Duration("backoff", 50*time.Millisecond),
+		maxBackoff:    cfg.Duration("maxBackoff", time.Second),
+		methods:       map[string]bool{},
+		statusCodes:   map[int]bool{},
+		bufferLimit:   int64(cfg.Int("bufferLimit", 1<<20)),
+	}
+
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}
+	if cfg.Has("methods") {
+		methods = cfg.StringSlice("methods")
+	}
+	for _, method := range methods {
+		policy.methods[strings.ToUpper(method)] = true
+	}
+
+	statusCodes := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	if cfg.Has("statusCodes") {
+		statusCodes = cfg.Ints("statusCodes")
+	}
+	for _, code := range statusCodes {
+		policy.statusCodes[code] = true
+	}
+
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if policy.attempts < 1 {
+		return nil, fmt.Errorf("retry attempts must be at least 1")
+	}
+	if policy.perTryTimeout < 0 || policy.backoff < 0 || policy.maxBackoff < 0 || policy.bufferLimit < 0 {
+		return nil, fmt.Errorf("retry durations and bufferLimit must not be negative")
+	}
+
+	return policy, nil
+}
+
+// reports whether the request may be sent more than once
+func (p *retryPolicy) allows(r *http.Request) bool {
+	// an upgraded connection can't be replayed once it has been handed over
+	if isUpgradeRequest(r) {
+		return false
+	}
+	return p.attempts > 1 && p.methods[r.Method]
+}
+
+// returns how long to wait before the given retry, doubling each time with some jitter so clients that failed
+// together don't retry together
+func (p *retryPolicy) delay(retry int) time.Duration {
+	if p.backoff == 0 {
+		return 0
+	}
+
+	d := p.backoff << (retry - 1)
+	if d > p.maxBackoff || d <= 0 {
+		d = p.maxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// reads the request body into memory so it can be sent again. If the body is larger than limit the request is
+// left able to be sent once and false is returned
+func bufferBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	return body, true, nil
+}
+
+// cancels the per-try context of a request once its response body has been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
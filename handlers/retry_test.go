@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+func TestRetryPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]any
+		method  string
+		upgrade bool
+		want    bool
+	}{
+		{"GET is idempotent", nil, http.MethodGet, false, true},
+		{"PUT is idempotent", nil, http.MethodPut, false, true},
+		{"DELETE is idempotent", nil, http.MethodDelete, false, true},
+		{"POST isn't idempotent", nil, http.MethodPost, false, false},
+		{"PATCH isn't idempotent", nil, http.MethodPatch, false, false},
+		{"upgrades are never retried", nil, http.MethodGet, true, false},
+		{"a single attempt never retries", map[string]any{"attempts": 1}, http.MethodGet, false, false},
+		{"methods can be chosen", map[string]any{"methods": []any{"post"}}, http.MethodPost, false, true},
+		{"chosen methods replace the defaults", map[string]any{"methods": []any{"post"}}, http.MethodGet, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := buildRetryPolicy(config.NewTable(tt.cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.upgrade {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+			if got := policy.allows(r); got != tt.want {
+				t.Errorf("allows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRetryPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"no attempts", map[string]any{"attempts": 0}},
+		{"negative backoff", map[string]any{"backoff": "-1s"}},
+		{"negative buffer limit", map[string]any{"bufferlimit": -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildRetryPolicy(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := &retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 150 * time.Millisecond, 300 * time.Millisecond},
+		{60, 150 * time.Millisecond, 300 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if d := policy.delay(tt.retry); d < tt.min || d > tt.max {
+				t.Fatalf("delay(%d) = %s, want between %s and %s", tt.retry, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		replayable bool
+	}{
+		{"empty", "", true},
+		{"under the limit", "abc", true},
+		{"at the limit", "abcd", true},
+		{"over the limit", "abcde", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+			if tt.body == "" {
+				r.Body = http.NoBody
+			}
+
+			body, replayable, err := bufferBody(r, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replayable != tt.replayable {
+				t.Fatalf("replayable = %v, want %v", replayable, tt.replayable)
+			}
+			if replayable {
+				if string(body) != tt.body {
+					t.Errorf("body = %q, want %q", body, tt.body)
+				}
+				return
+			}
+
+			// a body too large to buffer must still reach the upstream in full
+			rest, _ := io.ReadAll(r.Body)
+			if string(rest) != tt.body {
+				t.Errorf("remaining body = %q, want %q", rest, tt.body)
+			}
+		})
+	}
+}
+
+// returns an upstream that fails its first request with a 502 and then succeeds, along with the number of requests
+// it has received
+func flakyUpstream(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	var hits atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestReverseProxyRetriesIdempotentRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		methods  []any
+		wantCode int
+		wantHits int64
+	}{
+		{"GET is retried", http.MethodGet, nil, http.StatusOK, 2},
+		{"PUT is retried", http.MethodPut, nil, http.StatusOK, 2},
+		{"POST isn't retried", http.MethodPost, nil, http.StatusBadGateway, 1},
+		{"POST is retried when allowed", http.MethodPost, []any{"POST"}, http.StatusOK, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, hits := flakyUpstream(t)
+			retry := map[string]any{"attempts": 3, "backoff": "0s"}
+			if tt.methods != nil {
+				retry["methods"] = tt.methods
+			}
+			proxy := newTestProxy(t, nil, map[string]any{"target": upstream.URL, "retry": retry})
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest(tt.method, "/", strings.NewReader("body")))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream got %d requests, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
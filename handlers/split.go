@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// a weighted group of upstreams within a service, such as the stable and canary builds of an app
+type splitGroup struct {
+	name   string
+	weight int
+	pool   *upstreamPool
+
+	// number of requests sent to the group
+	requests atomic.Int64
+}
+
+// divides the traffic of a service between its groups in proportion to their weights. A header or cookie naming a
+// group can force requests to that group
+type trafficSplit struct {
+	groups      []*splitGroup
+	totalWeight int
+
+	overrideHeader string
+	overrideCookie string
+}
+
+// builds the traffic split of a service. Services without a `split` list have a single group holding all of
+// their targets
+func buildTrafficSplit(cfg *config.Table) (*trafficSplit, error) {
+	split := &trafficSplit{}
+
+	if !cfg.Has("split") {
+		pool, err := buildUpstreamPool(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		split.groups = []*splitGroup{{name: "default", weight: 1, pool: pool}}
+		split.totalWeight = 1
+		return split, nil
+	}
+
+	if cfg.Has("target") || cfg.Has("targets") {
+		return nil, fmt.Errorf("targets must be set on each split group instead of the service")
+	}
+
+	names := map[string]bool{}
+	for _, groupCfg := range cfg.Tables("split") {
+		group := &splitGroup{
+			name:   groupCfg.String("name", ""),
+			weight: groupCfg.Int("weight", 1),
+		}
+		if err := groupCfg.Err(); err != nil {
+			return nil, err
+		}
+
+		if group.name == "" {
+			return nil, fmt.Errorf("split groups must have a name")
+		}
+		if names[group.name] {
+			return nil, fmt.Errorf("split group '%s' is defined more than once", group.name)
+		}
+		names[group.name] = true
+
+		if group.weight < 0 {
+			return nil, fmt.Errorf("split group '%s' must not have a negative weight", group.name)
+		}
+
+		pool, err := buildUpstreamPool(groupCfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s in split group '%s'", err, group.name)
+		}
+		group.pool = pool
+
+		split.groups = append(split.groups, group)
+		split.totalWeight += group.weight
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if split.totalWeight == 0 {
+		return nil, fmt.Errorf("at least one split group must have a weight above 0")
+	}
+
+	override := cfg.Table("splitOverride")
+	split.overrideHeader = override.String("header", "")
+	split.overrideCookie = override.String("cookie", "")
+
+	return split, cfg.Err()
+}
+
+// returns the group with the given name, or nil if there isn't one
+func (s *trafficSplit) group(name string) *splitGroup {
+	for _, group := range s.groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// returns the group forced by the request's override header or cookie, if any
+func (s *trafficSplit) override(r *http.Request) *splitGroup {
+	if s.overrideHeader != "" {
+		if group := s.group(r.Header.Get(s.overrideHeader)); group != nil {
+			return group
+		}
+	}
+
+	if s.overrideCookie != "" {
+		if cookie, err := r.Cookie(s.overrideCookie); err == nil {
+			return s.group(cookie.Value)
+		}
+	}
+
+	return nil
+}
+
+// picks the group that should handle the request. Groups whose upstreams are all unavailable are skipped unless
+// every group is unavailable
+func (s *trafficSplit) pick(r *http.Request) *splitGroup {
+	group := s.override(r)
+	if group == nil && len(s.groups) == 1 {
+		group = s.groups[0]
+	}
+
+	if group == nil {
+		var candidates []*splitGroup
+		total := 0
+		for _, g := range s.groups {
+			if g.weight == 0 {
+				continue
+			}
+			if _, err := g.pool.available(); err == nil {
+				candidates = append(candidates, g)
+				total += g.weight
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = s.groups
+			total = s.totalWeight
+		}
+
+		n := rand.IntN(total)
+		for _, g := range candidates {
+			if n < g.weight {
+				group = g
+				break
+			}
+			n -= g.weight
+		}
+	}
+
+	group.requests.Add(1)
+	return group
+}
+
+// returns every upstream across all groups
+func (s *trafficSplit) upstreams() []*Upstream {
+	var upstreams []*Upstream
+	for _, group := range s.groups {
+		upstreams = append(upstreams, group.pool.upstreams...)
+	}
+	return upstreams
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// builds a split with a group for each name with the given weight, each group having a single target
+func newTestSplit(t *testing.T, weights map[string]int, override map[string]any) *trafficSplit {
+	t.Helper()
+	groups := []any{}
+	for _, name := range []string{"stable", "canary", "dark"} {
+		if weight, ok := weights[name]; ok {
+			groups = append(groups, map[string]any{"name": name, "weight": weight, "target": "http://" + name + ".test"})
+		}
+	}
+
+	split, err := buildTrafficSplit(config.NewTable(map[string]any{"split": groups, "splitoverride": override}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return split
+}
+
+// returns how many of n requests were sent to each group
+func pickCounts(split *trafficSplit, r *http.Request, n int) map[string]int {
+	counts := map[string]int{}
+	for range n {
+		counts[split.pick(r).name]++
+	}
+	return counts
+}
+
+func TestTrafficSplitWeights(t *testing.T) {
+	split := newTestSplit(t, map[string]int{"stable": 3, "canary": 1, "dark": 0}, nil)
+
+	const n = 8000
+	counts := pickCounts(split, httptest.NewRequest(http.MethodGet, "/", nil), n)
+	if counts["dark"] != 0 {
+		t.Errorf("a group with a weight of 0 got %d requests", counts["dark"])
+	}
+	if share := float64(counts["canary"]) / n; math.Abs(share-0.25) > 0.03 {
+		t.Errorf("canary got %.1f%% of requests, want 25%%", share*100)
+	}
+
+	for _, group := range split.groups {
+		if got := group.requests.Load(); got != int64(counts[group.name]) {
+			t.Errorf("group %s counted %d requests, want %d", group.name, got, counts[group.name])
+		}
+	}
+}
+
+func TestTrafficSplitOverride(t *testing.T) {
+	split := newTestSplit(t, map[string]int{"stable": 1, "canary": 0, "dark": 0}, map[string]any{
+		"header": "X-Split-Group",
+		"cookie": "split_group",
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   string
+	}{
+		{"no override", "", "", "stable"},
+		{"header", "canary", "", "canary"},
+		{"cookie", "", "dark", "dark"},
+		{"header beats the cookie", "canary", "dark", "canary"},
+		{"unknown group in the header falls back to the cookie", "beta", "dark", "dark"},
+		{"unknown group", "beta", "beta", "stable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Split-Group", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "split_group", Value: tt.cookie})
+			}
+
+			if got := pickCounts(split, r, 20); got[tt.want] != 20 {
+				t.Errorf("picked %v, want only %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitSkipsUnavailableGroups(t *testing.T) {
+	tests := []struct {
+		name      string
+		unhealthy []string
+		want      map[string]bool
+	}{
+		{"every group available", nil, map[string]bool{"stable": true, "canary": true}},
+		{"group without healthy upstreams", []string{"canary"}, map[string]bool{"stable": true}},
+		// with nothing available anywhere the weights still decide, so the request gets the group's error page
+		{"every group unavailable", []string{"stable", "canary"}, map[string]bool{"stable": true, "canary": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			split := newTestSplit(t, map[string]int{"stable": 1, "canary": 1}, nil)
+			for _, name := range tt.unhealthy {
+				split.group(name).pool.upstreams[0].healthy.Store(false)
+			}
+
+			for name := range pickCounts(split, httptest.NewRequest(http.MethodGet, "/", nil), 200) {
+				if !tt.want[name] {
+					t.Errorf("request was sent to %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildTrafficSplitErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"target on the service", map[string]any{"target": "http://a.test", "split": []any{map[string]any{"name": "a", "target": "http://a.test"}}}},
+		{"group without a name", map[string]any{"split": []any{map[string]any{"target": "http://a.test"}}}},
+		{"group defined twice", map[string]any{"split": []any{
+			map[string]any{"name": "a", "target": "http://a.test"},
+			map[string]any{"name": "a", "target": "http://b.test"},
+		}}},
+		{"negative weight", map[string]any{"split": []any{map[string]any{"name": "a", "weight": -1, "target": "http://a.test"}}}},
+		{"no weight above 0", map[string]any{"split": []any{map[string]any{"name": "a", "weight": 0, "target": "http://a.test"}}}},
+		{"group without targets", map[string]any{"split": []any{map[string]any{"name": "a"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildTrafficSplit(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
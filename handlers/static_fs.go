@@ -3,14 +3,16 @@ package handlers
 import (
 	"compress/flate"
 	"compress/gzip"
-	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/grqphical/interchange/config"
 	"github.com/grqphical/interchange/templates"
 )
 
@@ -21,6 +23,8 @@ type InterchangeStaticFSHandler struct {
 	showDirPages     bool
 	compression      string
 	compressionLevel int
+	paths            *pathRewriter
+	headers          *headerRules
 }
 
 func writeFileData(w http.ResponseWriter, r *http.Request, data []byte, compression string, compressionLevel int) {
@@ -70,43 +74,67 @@ func writeFileData(w http.ResponseWriter, r *http.Request, data []byte, compress
 }
 
 func (i InterchangeStaticFSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	file := strings.Replace(r.RequestURI, i.route, "", 1)
-	fullFilePath := filepath.Join(i.directory, file)
+	if i.headers != nil {
+		w = i.headers.wrapResponseWriter(w, r)
+	}
 
-	info, err := os.Stat(fullFilePath)
-	if errors.Is(err, os.ErrNotExist) {
-		templates.WriteError(w, 404, "Not Found")
+	urlPath := r.URL.Path
+	if i.paths != nil {
+		urlPath = i.paths.rewritePath(urlPath)
+	}
+
+	// the decoded path is cleaned as if it were rooted so `..` segments, including ones sent encoded as %2e%2e,
+	// can't climb above the directory
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(urlPath, i.route)), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		templates.WriteError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	// files are opened through the root so symlinks can't lead outside of the directory either
+	root, err := os.OpenRoot(i.directory)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to open directory '%s'", i.directory), "err", err)
+		templates.WriteError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
+	defer root.Close()
+	fullFilePath := filepath.Join(i.directory, filepath.FromSlash(name))
 
-	data, err := os.ReadFile(fullFilePath)
+	info, err := root.Stat(name)
 	if err != nil {
-		if info.IsDir() {
-			// serve index.html from within the directory if it exists
-			data, err := os.ReadFile(filepath.Join(fullFilePath, "index.html"))
-			if err == nil {
-				w.Header().Set("Content-Type", "text/html")
-
-				writeFileData(w, r, data, i.compression, i.compressionLevel)
-
-				return
-			} else {
-				// show the directory browser if the user configured it to be shown
-				if i.showDirPages {
-					templates.WriteDirectoryTemplate(w, fullFilePath, r.RequestURI, i.directory)
-				} else {
-					templates.WriteError(w, http.StatusNotFound, "Not Found")
-					return
-				}
-			}
-
-		} else {
+		templates.WriteError(w, 404, "Not Found")
+		return
+	}
+
+	if !info.IsDir() {
+		data, err := fs.ReadFile(root.FS(), name)
+		if err != nil {
 			templates.WriteError(w, 500, "Internal Server Error")
+			return
 		}
+		writeFileData(w, r, data, i.compression, i.compressionLevel)
 		return
 	}
 
-	writeFileData(w, r, data, i.compression, i.compressionLevel)
+	// serve index.html from within the directory if it exists
+	data, err := fs.ReadFile(root.FS(), path.Join(name, "index.html"))
+	if err == nil {
+		w.Header().Set("Content-Type", "text/html")
+
+		writeFileData(w, r, data, i.compression, i.compressionLevel)
+		return
+	}
+
+	// show the directory browser if the user configured it to be shown
+	if i.showDirPages {
+		templates.WriteDirectoryTemplate(w, fullFilePath, r.URL.Path, i.directory)
+	} else {
+		templates.WriteError(w, http.StatusNotFound, "Not Found")
+	}
 }
 
 func BuildStaticFileSystemHandler(service map[string]any, name string, route string) (http.Handler, bool) {
@@ -134,11 +162,26 @@ func BuildStaticFileSystemHandler(service map[string]any, name string, route str
 		compressionLevel = 4
 	}
 
+	cfg := config.NewTable(service)
+	paths, err := buildPathRewriter(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
+	}
+
+	headers, err := buildHeaderRules(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
+	}
+
 	return InterchangeStaticFSHandler{
 		route,
 		directory,
 		showDirPages.(bool),
 		compression.(string),
 		compressionLevel.(int),
+		paths,
+		headers,
 	}, true
 }
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticFSStaysInDirectory(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "public")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0o644)
+	os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0o644)
+	if err := os.Symlink(filepath.Join(parent, "secret.txt"), filepath.Join(dir, "link.txt")); err != nil {
+		t.Skip("symlinks aren't supported:", err)
+	}
+
+	handler, ok := BuildStaticFileSystemHandler(map[string]any{
+		"directory":            dir,
+		"showdirectorybrowser": false,
+	}, "test", "/static/")
+	if !ok {
+		t.Fatal("failed to build the service")
+	}
+
+	tests := []struct {
+		target   string
+		wantCode int
+		wantBody string
+	}{
+		{"/static/hello.txt", http.StatusOK, "hello"},
+		{"/static/../secret.txt", http.StatusNotFound, ""},
+		{"/static/%2e%2e/secret.txt", http.StatusNotFound, ""},
+		{"/static/%2E%2E%2Fsecret.txt", http.StatusNotFound, ""},
+		{"/static/x/../../secret.txt", http.StatusNotFound, ""},
+		{"/static/link.txt", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			body, _ := io.ReadAll(w.Body)
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
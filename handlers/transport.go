@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/middleware"
+	"github.com/grqphical/interchange/proxyproto"
+)
+
+// builds the transport used to connect to the upstreams of a service from its `transport` table
+func buildHTTPTransport(cfg *config.Table) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.Duration("dialTimeout", 30*time.Second),
+		KeepAlive: cfg.Duration("keepAlive", 30*time.Second),
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = cfg.Duration("tlsHandshakeTimeout", 10*time.Second)
+	transport.ResponseHeaderTimeout = cfg.Duration("responseHeaderTimeout", 0)
+	transport.IdleConnTimeout = cfg.Duration("idleConnTimeout", 90*time.Second)
+	transport.MaxIdleConns = cfg.Int("maxIdleConns", 100)
+	transport.MaxIdleConnsPerHost = cfg.Int("maxIdleConnsPerHost", 16)
+	transport.MaxConnsPerHost = cfg.Int("maxConnsPerHost", 0)
+	transport.DisableKeepAlives = cfg.Bool("disableKeepAlives", false)
+	proxyProtocol := cfg.String("proxyProtocol", "")
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if dialer.Timeout < 0 || transport.TLSHandshakeTimeout < 0 || transport.ResponseHeaderTimeout < 0 || transport.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("transport timeouts must not be negative")
+	}
+	if transport.MaxIdleConns < 0 || transport.MaxIdleConnsPerHost < 0 || transport.MaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("transport connection limits must not be negative")
+	}
+
+	switch proxyProtocol {
+	case "":
+	case "v1", "v2":
+		version := 1
+		if proxyProtocol == "v2" {
+			version = 2
+		}
+		transport.DialContext = proxyProtocolDialer(dialer, version)
+		// the header describes a single client, so a connection can't be reused for anyone else's requests. HTTP/2
+		// is turned off for the same reason as it multiplexes requests from many clients over one connection
+		transport.DisableKeepAlives = true
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	default:
+		return nil, fmt.Errorf("invalid transport proxyProtocol '%s', must be 'v1' or 'v2'", proxyProtocol)
+	}
+
+	return transport, nil
+}
+
+// returns a dial function that starts every connection with a PROXY protocol header describing the client whose
+// request the connection is for. Connections made for anything other than a client's request, such as health checks,
+// send a header without an address
+func proxyProtocolDialer(dialer *net.Dialer, version int) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var header *proxyproto.Header
+		if client, ok := middleware.ClientAddrFromContext(ctx); ok {
+			header = &proxyproto.Header{Source: client}
+			if local, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+				header.Destination, _ = netip.ParseAddrPort(local.String())
+			}
+		}
+
+		if _, err := conn.Write(header.Format(version)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// sits between the reverse proxy and the real transport. Requests without an upstream fail cleanly, the outcome of
+// every request is reported to the upstream's circuit breaker and failed requests are retried against other
+// upstreams
+type upstreamTransport struct {
+	name  string
+	base  http.RoundTripper
+	retry *retryPolicy
+}
+
+func (t *upstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	state := r.Context().Value(proxyStateKey{}).(*proxyState)
+	if state.upstream == nil {
+		return nil, state.err
+	}
+
+	if t.retry == nil || !t.retry.allows(r) {
+		return t.send(r, state)
+	}
+
+	body, replayable, err := bufferBody(r, t.retry.bufferLimit)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return t.send(r, state)
+	}
+
+	tried := make([]*Upstream, 0, t.retry.attempts)
+	for attempt := 1; ; attempt++ {
+		tried = append(tried, state.upstream)
+
+		req := r.Clone(r.Context())
+		if attempt > 1 {
+			// point the request at the new upstream, keeping any Host set by the rewrite hook
+			req.URL = new(url.URL)
+			*req.URL = *state.outURL
+			(&httputil.ProxyRequest{Out: req}).SetURL(state.upstream.URL)
+			req.Host = r.Host
+		}
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+
+		cancel := context.CancelFunc(func() {})
+		if t.retry.perTryTimeout > 0 {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(req.Context(), t.retry.perTryTimeout)
+			req = req.WithContext(ctx)
+		}
+
+		resp, err := t.send(req, state)
+
+		retry := attempt < t.retry.attempts && r.Context().Err() == nil &&
+			(err != nil || t.retry.statusCodes[resp.StatusCode])
+		if !retry {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelOnClose{resp.Body, cancel}
+			return resp, nil
+		}
+
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = fmt.Errorf("upstream responded with %s", resp.Status)
+		}
+		cancel()
+
+		slog.Warn(fmt.Sprintf("service '%s' attempt %d of %s %s to %s failed, retrying", t.name, attempt, r.Method, r.URL.Path, state.upstream.URL), "err", err)
+
+		select {
+		case <-time.After(t.retry.delay(attempt)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+
+		next, err := state.pool.nextExcluding(state.in, tried)
+		if err != nil {
+			return nil, err
+		}
+		state.upstream.release(state.reported)
+		state.upstream = next
+		state.reported = false
+	}
+}
+
+// sends a request to the current upstream, reporting the outcome to its circuit breaker
+func (t *upstreamTransport) send(r *http.Request, state *proxyState) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+
+	if breaker := state.upstream.breaker; breaker != nil {
+		switch {
+		case errors.Is(state.in.Context().Err(), context.Canceled):
+			// cancelled by the client, which says nothing about the upstream. Running out of time on the service's
+			// timeout does, so that is recorded as a failure below
+			breaker.release()
+		case err != nil:
+			breaker.record(false)
+		default:
+			breaker.record(resp.StatusCode < 500)
+		}
+	}
+	state.reported = true
+
+	return resp, err
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+func TestBuildHTTPTransportErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"negative dial timeout", map[string]any{"dialtimeout": "-1s"}},
+		{"negative response header timeout", map[string]any{"responseheadertimeout": "-1s"}},
+		{"negative connection limit", map[string]any{"maxconnsperhost": -1}},
+		{"unknown proxy protocol", map[string]any{"proxyprotocol": "v3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := buildHTTPTransport(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestBuildHTTPTransportProxyProtocol(t *testing.T) {
+	transport, err := buildHTTPTransport(config.NewTable(map[string]any{"proxyprotocol": "v2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !transport.DisableKeepAlives || transport.ForceAttemptHTTP2 {
+		t.Error("connections carrying a PROXY header must not be reused or multiplexed")
+	}
+}
+
+// a slow upstream either runs into the service's timeout, which counts against its circuit breaker, or is abandoned
+// by the client, which doesn't
+func TestUpstreamTransportBreakerOutcome(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientCancel bool
+		want         breakerState
+	}{
+		{"service timeout is a failure", false, breakerOpen},
+		{"client cancellation is ignored", true, breakerClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}, map[string]any{
+				"timeout": "50ms",
+				"circuitbreaker": map[string]any{
+					"minrequests":  1,
+					"failureratio": 1.0,
+				},
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.clientCancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+			proxy.ServeHTTP(httptest.NewRecorder(), r)
+
+			breaker := proxy.split.upstreams()[0].breaker
+			if got := breaker.currentState(); got != tt.want {
+				t.Errorf("breaker state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// a single backend server that a reverse proxy service forwards requests to
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+
+	// number of requests currently being proxied to this upstream
+	active atomic.Int64
+
+	// set by active health checks
+	healthy atomic.Bool
+
+	// nil unless the service has a circuit breaker configured
+	breaker *circuitBreaker
+}
+
+// returns the number of requests currently being handled by the upstream
+func (u *Upstream) ActiveRequests() int64 {
+	return u.active.Load()
+}
+
+// reports whether the upstream passed its most recent health checks
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// reserves the upstream for a request that is about to be sent to it, returning false if its circuit breaker won't
+// let the request through
+func (u *Upstream) acquire() bool {
+	if u.breaker != nil && !u.breaker.acquire() {
+		return false
+	}
+	u.active.Add(1)
+	return true
+}
+
+// gives back what acquire reserved once a request is done with the upstream. If the request never got as far as
+// reporting its outcome, for example because the client's body couldn't be read, its circuit breaker slot is freed
+// too so a half-open breaker isn't left waiting on a probe that will never finish
+func (u *Upstream) release(reported bool) {
+	u.active.Add(-1)
+	if u.breaker != nil && !reported {
+		u.breaker.release()
+	}
+}
+
+// the set of upstreams belonging to a service along with the balancer used to pick between them
+type upstreamPool struct {
+	upstreams []*Upstream
+	balancer  Balancer
+
+	// nil unless the service has sticky sessions enabled
+	sticky *stickySessions
+}
+
+// returns the upstreams that are currently able to take requests. If there are none the error explains why
+func (p *upstreamPool) available() ([]*Upstream, error) {
+	candidates := make([]*Upstream, 0, len(p.upstreams))
+	healthy := 0
+	for _, upstream := range p.upstreams {
+		if !upstream.Healthy() {
+			continue
+		}
+		healthy++
+
+		if upstream.breaker == nil || upstream.breaker.ready() {
+			candidates = append(candidates, upstream)
+		}
+	}
+
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+	if healthy > 0 {
+		return nil, errCircuitOpen
+	}
+	return nil, errNoUpstream
+}
+
+// picks the upstream that should handle the given request and reserves it
+func (p *upstreamPool) next(r *http.Request) (*Upstream, error) {
+	return p.nextExcluding(r, nil)
+}
+
+// picks the upstream that should handle the given request and reserves it, avoiding the excluded upstreams unless
+// they are the only ones available
+func (p *upstreamPool) nextExcluding(r *http.Request, exclude []*Upstream) (*Upstream, error) {
+	candidates, err := p.available()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(exclude) > 0 {
+		remaining := slices.DeleteFunc(slices.Clone(candidates), func(u *Upstream) bool {
+			return slices.Contains(exclude, u)
+		})
+		if len(remaining) > 0 {
+			candidates = remaining
+		}
+	}
+
+	for len(candidates) > 0 {
+		upstream := p.pick(r, candidates)
+		if upstream.acquire() {
+			return upstream, nil
+		}
+
+		// another request took the upstream's last probe slot after it was found to be available
+		candidates = slices.DeleteFunc(candidates, func(u *Upstream) bool {
+			return u == upstream
+		})
+	}
+	return nil, errCircuitOpen
+}
+
+// picks one of the candidates for the request
+func (p *upstreamPool) pick(r *http.Request, candidates []*Upstream) *Upstream {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	if p.sticky != nil {
+		if upstream := p.sticky.lookup(r, candidates); upstream != nil {
+			return upstream
+		}
+	}
+
+	return p.balancer.Next(r, candidates)
+}
+
+// returns the scheme, host, port and path of an upstream's URL in a canonical form, so targets that are written
+// differently but point at the same place have the same key
+func upstreamKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if strings.EqualFold(u.Scheme, "https") {
+			port = "443"
+		}
+	}
+	host := net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+	return strings.ToLower(u.Scheme) + "://" + host + strings.TrimSuffix(u.EscapedPath(), "/")
+}
+
+// parses a single entry of a service's targets, which can either be a URL string or a table
+// containing a url and an optional weight
+func parseUpstream(value any) (*Upstream, error) {
+	var target string
+	weight := 1
+
+	switch v := value.(type) {
+	case string:
+		target = v
+	case map[string]any:
+		t := config.NewTable(v)
+		target = t.String("url", "")
+		weight = t.Int("weight", 1)
+		if err := t.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("target must be a URL or a table containing a url")
+	}
+
+	if target == "" {
+		return nil, fmt.Errorf("target is missing a url")
+	}
+
+	targetURL, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, fmt.Errorf("target '%s' is an invalid URL", target)
+	}
+
+	if weight < 1 {
+		return nil, fmt.Errorf("target '%s' must have a weight of at least 1", target)
+	}
+
+	upstream := &Upstream{URL: targetURL, Weight: weight}
+	upstream.healthy.Store(true)
+
+	return upstream, nil
+}
+
+// builds the upstream pool for a service from either its `target` or `targets` setting
+func buildUpstreamPool(service *config.Table) (*upstreamPool, error) {
+	var values []any
+	if target, exists := service.Get("target"); exists {
+		values = append(values, target)
+	}
+	if targets, exists := service.Get("targets"); exists {
+		list, ok := targets.([]any)
+		if !ok {
+			return nil, fmt.Errorf("targets must be a list")
+		}
+		values = append(values, list...)
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("target not set")
+	}
+
+	pool := &upstreamPool{}
+	// sticky cookies and the hash ring identify upstreams by their URL, so the same target can't be listed twice
+	seen := map[string]bool{}
+	for _, value := range values {
+		upstream, err := parseUpstream(value)
+		if err != nil {
+			return nil, err
+		}
+		key := upstreamKey(upstream.URL)
+		if seen[key] {
+			return nil, fmt.Errorf("target '%s' is listed more than once", upstream.URL)
+		}
+		seen[key] = true
+		pool.upstreams = append(pool.upstreams, upstream)
+	}
+
+	balancer, err := newBalancer(service, pool.upstreams)
+	if err != nil {
+		return nil, err
+	}
+	pool.balancer = balancer
+
+	if service.Has("stickyCookie") {
+		pool.sticky, err = newStickySessions(service.Table("stickyCookie"), pool.upstreams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pool, service.Err()
+}
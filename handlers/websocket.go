@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// limits on connections that have been upgraded to another protocol, such as WebSockets
+type upgradeSettings struct {
+	// upgraded connections with no traffic in either direction for this long are closed. Zero disables the timeout
+	idleTimeout time.Duration
+	// maximum number of upgraded connections open at once. Zero means unlimited
+	maxConnections int64
+
+	open atomic.Int64
+}
+
+func buildUpgradeSettings(cfg *config.Table) (*upgradeSettings, error) {
+	settings := &upgradeSettings{
+		idleTimeout:    cfg.Duration("idleTimeout", 0),
+		maxConnections: int64(cfg.Int("maxConnections", 0)),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if settings.idleTimeout < 0 || settings.maxConnections < 0 {
+		return nil, fmt.Errorf("websocket idleTimeout and maxConnections must not be negative")
+	}
+
+	return settings, nil
+}
+
+// reserves a connection slot, returning false if the limit has been reached
+func (s *upgradeSettings) acquire() bool {
+	if s.open.Add(1) > s.maxConnections && s.maxConnections > 0 {
+		s.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *upgradeSettings) release() {
+	s.open.Add(-1)
+}
+
+// reports whether the client is asking to switch protocols
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != ""
+}
+
+// parses a flush interval which is either a duration or "immediate" to flush after every write
+func parseFlushInterval(cfg *config.Table) time.Duration {
+	if cfg.String("flushInterval", "") == "immediate" {
+		return -1
+	}
+	return cfg.Duration("flushInterval", 0)
+}
+
+// closes an upgraded connection once no data has passed through it for the idle timeout
+type idleTimeoutConn struct {
+	io.ReadWriteCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutConn(conn io.ReadWriteCloser, timeout time.Duration) *idleTimeoutConn {
+	c := &idleTimeoutConn{ReadWriteCloser: conn, timeout: timeout}
+	// closing the upstream side ends the copy loops of the reverse proxy which then closes the client side
+	c.timer = time.AfterFunc(timeout, func() {
+		conn.Close()
+	})
+	return c
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Close() error {
+	c.timer.Stop()
+	return c.ReadWriteCloser.Close()
+}
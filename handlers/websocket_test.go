@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+func TestParseFlushInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]any
+		want    time.Duration
+		wantErr bool
+	}{
+		{"not set", map[string]any{}, 0, false},
+		{"immediate", map[string]any{"flushinterval": "immediate"}, -1, false},
+		{"duration", map[string]any{"flushinterval": "100ms"}, 100 * time.Millisecond, false},
+		{"invalid", map[string]any{"flushinterval": "soon"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewTable(tt.cfg)
+			got := parseFlushInterval(cfg)
+			if err := cfg.Err(); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("flush interval = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildUpgradeSettingsErrors(t *testing.T) {
+	for _, cfg := range []map[string]any{{"idletimeout": "-1s"}, {"maxconnections": -1}} {
+		if _, err := buildUpgradeSettings(config.NewTable(cfg)); err == nil {
+			t.Errorf("expected an error for %v", cfg)
+		}
+	}
+}
+
+// starts a proxy in front of an upstream that accepts protocol upgrades and then echoes whatever it is sent
+func newUpgradingProxy(t *testing.T, websocket map[string]any) (*ReverseProxyService, string) {
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}, map[string]any{"websocket": websocket})
+
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, server.Listener.Addr().String()
+}
+
+// asks the proxy to upgrade a new connection, returning it along with the status of the response
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+	}
+	return conn, br, resp.StatusCode
+}
+
+// sends a message over an upgraded connection and checks it is echoed back
+func echo(t *testing.T, conn net.Conn, br *bufio.Reader, message string) {
+	t.Helper()
+	conn.Write([]byte(message + "\n"))
+	got, err := br.ReadString('\n')
+	if err != nil || got != message+"\n" {
+		t.Fatalf("echoed %q (%v), want %q", got, err, message)
+	}
+}
+
+func TestWebSocketMaxConnections(t *testing.T) {
+	proxy, addr := newUpgradingProxy(t, map[string]any{"maxconnections": 2})
+
+	first, br, status := dialUpgrade(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", status, http.StatusSwitchingProtocols)
+	}
+	echo(t, first, br, "hello")
+	if _, _, status := dialUpgrade(t, addr); status != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", status, http.StatusSwitchingProtocols)
+	}
+
+	if _, _, status := dialUpgrade(t, addr); status != http.StatusServiceUnavailable {
+		t.Fatalf("status over the limit = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// plain requests aren't counted against the limit
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code == http.StatusServiceUnavailable {
+		t.Error("a request that isn't an upgrade was turned away")
+	}
+
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); proxy.upgrades.open.Load() > 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("closing a connection didn't free its slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, status := dialUpgrade(t, addr); status != http.StatusSwitchingProtocols {
+		t.Errorf("status once a slot was freed = %d, want %d", status, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	_, addr := newUpgradingProxy(t, map[string]any{"idletimeout": "300ms"})
+	conn, br, status := dialUpgrade(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", status, http.StatusSwitchingProtocols)
+	}
+
+	// traffic keeps the connection open well past the timeout
+	for i := range 8 {
+		time.Sleep(75 * time.Millisecond)
+		echo(t, conn, br, strings.Repeat("x", i+1))
+	}
+
+	start := time.Now()
+	if _, err := br.ReadString('\n'); err != io.EOF {
+		t.Fatalf("read on an idle connection returned %v, want EOF", err)
+	}
+	if idle := time.Since(start); idle < 200*time.Millisecond {
+		t.Errorf("connection was closed after %s of inactivity, want about 300ms", idle)
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	_ "embed"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os/exec"
 	"runtime"
+
+	"github.com/grqphical/interchange/config"
 )
 
 //go:embed wsgi_bridge.py
 var wsgi_bridge string
 
-func BuildWSGIHandler(service map[string]any) (http.Handler, bool) {
+func BuildWSGIHandler(service map[string]any, name string) (http.Handler, bool) {
 	var pythonCmd string
 	if runtime.GOOS == "windows" {
 		cmd := exec.Command("python", "--version")
@@ -38,7 +41,31 @@ func BuildWSGIHandler(service map[string]any) (http.Handler, bool) {
 		return nil, false
 	}
 
+	cfg := config.NewTable(service)
+	paths, err := buildPathRewriter(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
+	}
+
+	headers, err := buildHeaderRules(cfg)
+	if err != nil {
+		slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+		return nil, false
+	}
+
 	handlerFunc := func(w http.ResponseWriter, r *http.Request) {
+		if paths != nil || headers != nil {
+			r = r.Clone(r.Context())
+		}
+		if paths != nil {
+			paths.rewrite(r.URL)
+		}
+		if headers != nil {
+			headers.request.apply(r.Header, r)
+			w = headers.wrapResponseWriter(w, r)
+		}
+
 		cmd := exec.Command(pythonCmd, "-c", wsgi_bridge, module.(string))
 		var inputBuf bytes.Buffer
 		r.Write(&inputBuf)
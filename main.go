@@ -5,18 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/grqphical/interchange/config"
 	"github.com/grqphical/interchange/handlers"
 	"github.com/grqphical/interchange/middleware"
+	"github.com/grqphical/interchange/proxyproto"
 	"github.com/grqphical/interchange/templates"
 	"github.com/spf13/viper"
 
@@ -24,41 +26,44 @@ import (
 )
 
 var Version string = "interchange/0.1.0"
-var ProxyTable map[string]string = make(map[string]string)
 
 // sets the default global configuration
 func setDefaultConfig() {
 	viper.SetDefault("port", 80)
 	viper.SetDefault("hostAddress", "0.0.0.0")
 	viper.SetDefault("developmentMode", true)
-}
-
-func checkServiceHealth() {
-	for name, ip := range ProxyTable {
-		resp, err := http.DefaultClient.Get(ip)
-		if err != nil {
-			slog.Error(fmt.Sprintf("Service '%s' is offline", name))
-			continue
-		}
 
-		if resp.StatusCode >= 500 {
-			slog.Error(fmt.Sprintf("Service '%s' is offline", name))
-			continue
-		}
-	}
+	// read and write timeouts are disabled by default as they would cut off long lived streams and uploads
+	viper.SetDefault("readTimeout", "0s")
+	viper.SetDefault("readHeaderTimeout", "10s")
+	viper.SetDefault("writeTimeout", "0s")
+	viper.SetDefault("idleTimeout", "2m")
+	viper.SetDefault("proxyProtocol.headerTimeout", "5s")
 }
 
 // build a new HTTP router to be used by interchange, creating the debug handlers if developmentMode is true
-// and routing all the services defined in `interchange.toml`
-func buildHTTPRouter(logger *ApplicationLogHandler) chi.Router {
+// and routing all the services defined in `interchange.toml`. Background work started by services, such as health
+// checks, runs until ctx is cancelled. Rate limiters are built through limiters so they keep their state between
+// reloads
+func buildHTTPRouter(ctx context.Context, logger *ApplicationLogHandler, limiters *rateLimiters) (chi.Router, error) {
 	r := chi.NewRouter()
 
+	// the client's address is resolved before anything that logs or filters on it
+	r.Use(middleware.ClientIPMiddleware)
+	r.Use(chimiddleware.RequestID)
+	r.Use(middleware.RequestLogger)
+	r.Use(chimiddleware.Recoverer)
 	r.Use(middleware.BlacklistMiddleware)
-	r.Use(chimiddleware.Logger)
 	r.Use(middleware.WhitelistMiddleware)
-	r.Use(chimiddleware.Recoverer)
-	r.Use(chimiddleware.RequestID)
-	r.Use(chimiddleware.RealIP)
+
+	// the global limit covers every request, including ones that don't match a service
+	if viper.IsSet("rateLimit") {
+		limiter, err := limiters.build("", config.NewTable(viper.GetStringMap("rateLimit")))
+		if err != nil {
+			return nil, fmt.Errorf("%s in the global rateLimit", err)
+		}
+		r.Use(limiter.Middleware("global"))
+	}
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		templates.WriteError(w, http.StatusNotFound, "Not Found")
@@ -67,8 +72,9 @@ func buildHTTPRouter(logger *ApplicationLogHandler) chi.Router {
 		templates.WriteError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
 	})
 
+	debug := handlers.NewDebugHandler()
 	if viper.GetBool("developmentMode") {
-		r.Get("/debug", handlers.DebugHandler)
+		r.Get("/debug", debug.ServeHTTP)
 		r.Get("/debug/log", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			err := json.NewEncoder(w).Encode(logger.records)
@@ -79,6 +85,26 @@ func buildHTTPRouter(logger *ApplicationLogHandler) chi.Router {
 		})
 	}
 
+	// the cache admin endpoints are available in production as long as they are protected by a token. Without one
+	// development mode can still list the cache, but purging always needs the token as anyone who can reach the
+	// server, including other sites through a visitor's browser, could otherwise empty every cache
+	cacheAdmin := handlers.NewCacheAdminHandler()
+	token, err := adminToken()
+	if err != nil {
+		slog.Error("ConfigurationError", "err", err)
+	}
+	if token != "" || viper.GetBool("developmentMode") {
+		r.Group(func(r chi.Router) {
+			if token != "" {
+				r.Use(middleware.AdminAuthMiddleware(token))
+				r.Post("/debug/cache/purge", cacheAdmin.Purge)
+			}
+			r.Get("/debug/cache", cacheAdmin.ListEntries)
+		})
+	}
+
+	hosts := newHostRouter(viper.GetString("defaultHost"))
+
 serviceLoop:
 	for name, service := range viper.GetStringMap("services") {
 		service := service.(map[string]any)
@@ -88,12 +114,24 @@ serviceLoop:
 			continue serviceLoop
 		}
 
-		route, exists := service["route"]
+		_, exists = service["route"]
 		if !exists {
 			slog.Error("ConfigurationError", "err", fmt.Sprintf("route not set on service '%s'", name))
 			continue serviceLoop
 		}
 
+		serviceHosts, err := serviceHosts(service)
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			continue serviceLoop
+		}
+
+		serviceRoute, err := buildServiceRoute(service, name)
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			continue serviceLoop
+		}
+
 		switch serviceType.(string) {
 		case "reverseProxy":
 			proxy, success := handlers.BuildReverseProxyService(service, name)
@@ -101,103 +139,151 @@ serviceLoop:
 				continue serviceLoop
 			}
 
-			route := path.Join(route.(string), "*")
-			target := service["target"]
-			ProxyTable[name] = target.(string)
-
-			r.Handle(route, proxy)
+			proxy.StartHealthChecks(ctx)
+			debug.Register(name, proxy)
+			cacheAdmin.Register(name, proxy)
+			serviceRoute.handler = proxy
 		case "staticFS":
-			routeStr := route.(string)
-
-			if !strings.HasSuffix(routeStr, "/") {
-				routeStr += "/"
-			}
-
-			fs, success := handlers.BuildStaticFileSystemHandler(service, name, routeStr)
+			fs, success := handlers.BuildStaticFileSystemHandler(service, name, serviceRoute.prefix)
 			if !success {
-				continue
-			}
-
-			if !strings.HasSuffix(routeStr, "*") {
-				routeStr += "*"
+				continue serviceLoop
 			}
 
-			r.Handle(routeStr, fs)
+			serviceRoute.handler = fs
 		case "wsgi":
-			routeStr := route.(string)
-
-			if !strings.HasSuffix(routeStr, "/") {
-				routeStr += "/"
-			}
-
-			if !strings.HasSuffix(routeStr, "*") {
-				routeStr += "*"
-			}
-
-			wsgi, success := handlers.BuildWSGIHandler(service)
+			wsgi, success := handlers.BuildWSGIHandler(service, name)
 			if !success {
-				continue
+				continue serviceLoop
 			}
 
-			r.Handle(routeStr, wsgi)
+			serviceRoute.handler = wsgi
 		default:
 			slog.Error("ConfigurationError", "err", fmt.Sprintf("invalid mode set on service '%s'", name))
+			continue serviceLoop
+		}
 
+		serviceRoute.handler, err = wrapServiceHandler(ctx, serviceRoute.handler, service, name, limiters, debug)
+		if err != nil {
+			slog.Error("ConfigurationError", "err", fmt.Sprintf("%s on service '%s'", err, name))
+			continue serviceLoop
 		}
+
+		hosts.Handle(serviceHosts, serviceRoute)
 		slog.Info(fmt.Sprintf("loaded service '%s' of type '%s'", name, serviceType))
 	}
 
-	return r
+	r.Mount("/", hosts)
+
+	return r, nil
 }
 
-// starts a new instance of the server on a new thread
-func startServer(ctx context.Context) *http.Server {
-	server := http.Server{
-		Handler: buildHTTPRouter(slog.Default().Handler().(*ApplicationLogHandler)),
-		Addr:    fmt.Sprintf("%s:%d", viper.GetString("hostAddress"), viper.GetInt("port")),
+// returns the token protecting the admin endpoints, read from `admin.token` or the file set in `admin.tokenFile`
+func adminToken() (string, error) {
+	if file := viper.GetString("admin.tokenFile"); file != "" {
+		token, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read admin token file: %s", err)
+		}
+		return strings.TrimSpace(string(token)), nil
 	}
+	return viper.GetString("admin.token"), nil
+}
 
-	go func(ctx context.Context) {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
+// the settings of the server's listener, which can't be changed without restarting the server
+type listenerConfig struct {
+	addr     string
+	https    bool
+	certFile string
+	keyFile  string
+
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	// the sources allowed to send PROXY protocol headers, joined so the struct can be compared
+	proxyProtocolSources string
+	proxyProtocolTimeout time.Duration
+}
 
-		checkServiceHealth()
-		for {
-			select {
-			case <-ticker.C:
-				checkServiceHealth()
-			case <-ctx.Done():
-				return
-			}
-		}
+func currentListenerConfig() listenerConfig {
+	return listenerConfig{
+		addr:     fmt.Sprintf("%s:%d", viper.GetString("hostAddress"), viper.GetInt("port")),
+		https:    viper.Get("https") != nil,
+		certFile: viper.GetString("https.certificate_file"),
+		keyFile:  viper.GetString("https.key_file"),
+
+		readTimeout:       viper.GetDuration("readTimeout"),
+		readHeaderTimeout: viper.GetDuration("readHeaderTimeout"),
+		writeTimeout:      viper.GetDuration("writeTimeout"),
+		idleTimeout:       viper.GetDuration("idleTimeout"),
+
+		proxyProtocolSources: strings.Join(viper.GetStringSlice("proxyProtocol.trustedSources"), ","),
+		proxyProtocolTimeout: viper.GetDuration("proxyProtocol.headerTimeout"),
+	}
+}
+
+// opens the server's listener, accepting PROXY protocol headers from the trusted sources if there are any
+func (l listenerConfig) listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return nil, err
+	}
+	if l.proxyProtocolSources == "" {
+		return ln, nil
+	}
+
+	sources, err := middleware.ParseIPSet(strings.Split(l.proxyProtocolSources, ","), viper.GetStringMapStringSlice("ipGroups"))
+	if err != nil {
+		slog.Error("ConfigurationError", "err", err.Error()+" in proxyProtocol.trustedSources")
+	}
+	return &proxyproto.Listener{Listener: ln, Trusted: sources.Contains, HeaderTimeout: l.proxyProtocolTimeout}, nil
+}
+
+// starts a new instance of the server on a new thread
+func startServer(handler http.Handler) *http.Server {
+	listener := currentListenerConfig()
 
-	}(ctx)
+	server := http.Server{
+		Handler: handler,
+		Addr:    listener.addr,
+
+		ReadTimeout:       listener.readTimeout,
+		ReadHeaderTimeout: listener.readHeaderTimeout,
+		WriteTimeout:      listener.writeTimeout,
+		IdleTimeout:       listener.idleTimeout,
+	}
 
 	go func() {
-		if viper.Get("https") != nil {
-			slog.Info(fmt.Sprintf("Starting Interchange with HTTPS on %s:%d", viper.GetString("hostAddress"), viper.GetInt("port")))
-			certFile := viper.GetString("https.certificate_file")
-			if certFile == "" {
+		if listener.https {
+			slog.Info(fmt.Sprintf("Starting Interchange with HTTPS on %s", listener.addr))
+			if listener.certFile == "" {
 				slog.Error("Failed to initialize HTTPS: certificate_file not specified")
 				return
 			}
 
-			keyFile := viper.GetString("https.key_file")
-			if keyFile == "" {
+			if listener.keyFile == "" {
 				slog.Error("Failed to initialize HTTPS: key_file not specified")
 				return
 			}
-
-			if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
-				slog.Error("Failed to start server", "err", err)
-			}
 		} else {
-			slog.Info(fmt.Sprintf("Starting Interchange on %s:%d", viper.GetString("hostAddress"), viper.GetInt("port")))
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				slog.Error("Failed to start server", "err", err)
-			}
+			slog.Info(fmt.Sprintf("Starting Interchange on %s", listener.addr))
+		}
+
+		ln, err := listener.listen()
+		if err != nil {
+			slog.Error("Failed to start server", "err", err)
+			return
 		}
 
+		if listener.https {
+			err = server.ServeTLS(ln, listener.certFile, listener.keyFile)
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Failed to start server", "err", err)
+		}
 	}()
 
 	return &server
@@ -233,21 +319,37 @@ func main() {
 		logger.Warn("no interchange.toml found, using default configuration")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	router := &reloadableRouter{logger: logger.Handler().(*ApplicationLogHandler)}
+	if err := router.reload(context.Background()); err != nil {
+		logger.Error("ConfigurationError", "err", err)
+		os.Exit(1)
+	}
 
-	server := startServer(ctx)
+	listener := currentListenerConfig()
+	server := startServer(router)
 
-	// restart the server if the configuration is reloaded, ensuring the old server shuts down gracefully first
+	// swap in a new router when the configuration is reloaded. Requests already in flight finish on the old router
+	// while new requests use the new one. The server is only restarted if its listener settings changed, ensuring the
+	// old server shuts down gracefully first
 	viper.OnConfigChange(func(in fsnotify.Event) {
 		logger.Info("config changed, reloading config")
-		ProxyTable = make(map[string]string)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			slog.Error("failed to shutdown server", "err", err)
+		if err := router.reload(context.Background()); err != nil {
+			logger.Error("ConfigurationError", "err", err)
+			logger.Warn("failed to reload config, keeping the previous one")
 			return
 		}
-		server = startServer(ctx)
+
+		if newListener := currentListenerConfig(); newListener != listener {
+			logger.Info("listener settings changed, restarting server")
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("failed to shutdown server", "err", err)
+				return
+			}
+			listener = newListener
+			server = startServer(router)
+		}
 	})
 
 	if viper.GetBool("developmentMode") {
@@ -260,9 +362,10 @@ func main() {
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 
-	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
 		slog.Error("failed to shutdown server", "err", err)
 	}
+	router.stop()
 }
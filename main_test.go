@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCacheAdminEndpoints(t *testing.T) {
+	tests := []struct {
+		name            string
+		developmentMode bool
+		token           string
+		method          string
+		path            string
+		authorization   string
+		want            int
+	}{
+		{"list in development mode", true, "", http.MethodGet, "/debug/cache", "", http.StatusOK},
+		{"no purging without a token", true, "", http.MethodPost, "/debug/cache/purge?service=api", "", http.StatusNotFound},
+		{"nothing in production without a token", false, "", http.MethodGet, "/debug/cache", "", http.StatusNotFound},
+		{"list without the token", false, "secret", http.MethodGet, "/debug/cache", "", http.StatusUnauthorized},
+		{"list with a wrong token", false, "secret", http.MethodGet, "/debug/cache", "Bearer guess", http.StatusUnauthorized},
+		{"list with the token", false, "secret", http.MethodGet, "/debug/cache", "Bearer secret", http.StatusOK},
+		{"purge without the token", true, "secret", http.MethodPost, "/debug/cache/purge?service=api", "", http.StatusUnauthorized},
+		{"purge with the token", false, "secret", http.MethodPost, "/debug/cache/purge?service=api", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("developmentMode", tt.developmentMode)
+			viper.Set("admin.token", tt.token)
+
+			router := &reloadableRouter{logger: &ApplicationLogHandler{}}
+			if err := router.reload(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(router.stop)
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitReload(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set("developmentMode", false)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	targets := map[string]string{}
+	for _, name := range []string{"stable", "canary"} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/checkout/slow" {
+				close(started)
+				<-release
+			}
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(upstream.Close)
+		targets[name] = upstream.URL
+	}
+
+	setWeights := func(stable, canary int) {
+		viper.Set("services", map[string]any{"checkout": map[string]any{
+			"mode":  "reverseProxy",
+			"route": "/checkout",
+			"split": []any{
+				map[string]any{"name": "stable", "weight": stable, "target": targets["stable"]},
+				map[string]any{"name": "canary", "weight": canary, "target": targets["canary"]},
+			},
+		}})
+	}
+	router := &reloadableRouter{logger: &ApplicationLogHandler{}}
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	expectOnly := func(want string) {
+		t.Helper()
+		for range 20 {
+			if got := serve("/checkout/pay").Body.String(); got != want {
+				t.Fatalf("request was sent to %q, want %q", got, want)
+			}
+		}
+	}
+
+	setWeights(1, 0)
+	if err := router.reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.stop)
+	expectOnly("stable")
+
+	// a request still being handled when the weights change is left to finish on the group it was sent to
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() { inFlight <- serve("/checkout/slow") }()
+	<-started
+
+	setWeights(0, 1)
+	if err := router.reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectOnly("canary")
+
+	close(release)
+	if w := <-inFlight; w.Code != http.StatusOK || w.Body.String() != "stable" {
+		t.Errorf("in-flight request got %d %q, want 200 \"stable\"", w.Code, w.Body.String())
+	}
+}
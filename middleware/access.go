@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// a single allow or deny rule of an access list
+type accessRule struct {
+	allow     bool
+	addresses *IPSet
+}
+
+// decides which clients may use a service. Rules are checked in order and the first one containing the client's
+// address decides, falling back to the default action if none do
+type AccessList struct {
+	rules        []accessRule
+	defaultAllow bool
+
+	denyStatus  int
+	denyMessage string
+}
+
+// creates an access list from an `access` table
+func NewAccessList(cfg *config.Table) (*AccessList, error) {
+	defaultAction := cfg.String("default", "allow")
+	l := &AccessList{
+		denyStatus:  cfg.Int("denyStatus", http.StatusForbidden),
+		denyMessage: cfg.String("denyMessage", ""),
+	}
+	rules := cfg.Tables("rules")
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	switch defaultAction {
+	case "allow":
+		l.defaultAllow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid access default '%s', expected 'allow' or 'deny'", defaultAction)
+	}
+
+	if l.denyStatus < 400 || l.denyStatus > 599 {
+		return nil, fmt.Errorf("access denyStatus must be a 4xx or 5xx status code")
+	}
+	if l.denyMessage == "" {
+		l.denyMessage = http.StatusText(l.denyStatus)
+	}
+
+	for _, rule := range rules {
+		if rule.Has("allow") == rule.Has("deny") {
+			return nil, fmt.Errorf("each access rule must set exactly one of allow or deny")
+		}
+
+		allow := rule.Has("allow")
+		key := "deny"
+		if allow {
+			key = "allow"
+		}
+		entries := rule.StringSlice(key)
+		if err := rule.Err(); err != nil {
+			return nil, err
+		}
+
+		addresses, err := ParseIPSet(entries, ipGroups())
+		if err != nil {
+			return nil, err
+		}
+		l.rules = append(l.rules, accessRule{allow, addresses})
+	}
+
+	return l, nil
+}
+
+// reports whether the access list lets the request through
+func (l *AccessList) allows(r *http.Request) bool {
+	addr := ClientIP(r)
+	for _, rule := range l.rules {
+		if rule.addresses.Contains(addr) {
+			return rule.allow
+		}
+	}
+	return l.defaultAllow
+}
+
+// returns middleware that turns away requests the access list doesn't allow
+func (l *AccessList) Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !l.allows(r) {
+			templates.WriteError(w, l.denyStatus, l.denyMessage)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/spf13/viper"
+)
+
+func TestNewAccessListErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"unknown default", map[string]any{"default": "maybe"}},
+		{"deny status that isn't an error", map[string]any{"denystatus": 302}},
+		{"rule with allow and deny", map[string]any{"rules": []any{map[string]any{"allow": []any{"all"}, "deny": []any{"all"}}}}},
+		{"rule with neither", map[string]any{"rules": []any{map[string]any{}}}},
+		{"invalid address", map[string]any{"rules": []any{map[string]any{"deny": []any{"10.0.0.300"}}}}},
+		{"unknown group", map[string]any{"rules": []any{map[string]any{"allow": []any{"@nowhere"}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAccessList(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAccessListRules(t *testing.T) {
+	viper.Set("ipGroups", map[string]any{"office": []any{"192.0.2.0/24"}})
+	t.Cleanup(viper.Reset)
+
+	allow := func(entries ...any) any { return map[string]any{"allow": entries} }
+	deny := func(entries ...any) any { return map[string]any{"deny": entries} }
+
+	tests := []struct {
+		name   string
+		cfg    map[string]any
+		client string
+		want   bool
+	}{
+		{"no rules allow by default", map[string]any{}, "10.0.0.1", true},
+		{"no rules with a default of deny", map[string]any{"default": "deny"}, "10.0.0.1", false},
+		{"allowed by a rule", map[string]any{"default": "deny", "rules": []any{allow("10.0.0.0/8")}}, "10.0.0.1", true},
+		{"denied by a rule", map[string]any{"rules": []any{deny("10.0.0.0/8")}}, "10.0.0.1", false},
+		{"no rule matches", map[string]any{"default": "deny", "rules": []any{allow("10.0.0.0/8")}}, "11.0.0.1", false},
+		{"first match wins over a later allow", map[string]any{"rules": []any{deny("10.0.0.5"), allow("10.0.0.0/8")}}, "10.0.0.5", false},
+		{"earlier rule that doesn't match is skipped", map[string]any{"default": "deny", "rules": []any{deny("10.0.0.5"), allow("10.0.0.0/8")}}, "10.0.0.6", true},
+		{"first match wins over a later deny", map[string]any{"rules": []any{allow("10.0.0.0/8"), deny("10.0.0.5")}}, "10.0.0.5", true},
+		{"group in a rule", map[string]any{"default": "deny", "rules": []any{allow("@office")}}, "192.0.2.10", true},
+		{"deny everyone else", map[string]any{"rules": []any{allow("@office"), deny("all")}}, "198.51.100.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := newTestMiddleware(t, NewAccessList, tt.cfg)
+			if got := access.allows(requestFrom(tt.client)); got != tt.want {
+				t.Errorf("allows(%s) = %v, want %v", tt.client, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessListMiddleware(t *testing.T) {
+	access := newTestMiddleware(t, NewAccessList, map[string]any{
+		"default":     "deny",
+		"denystatus":  http.StatusNotFound,
+		"denymessage": "Nothing here",
+		"rules":       []any{map[string]any{"allow": []any{"10.0.0.1"}}},
+	})
+	handler := access.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("service"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, requestFrom("10.0.0.1"))
+	if w.Code != http.StatusOK || w.Body.String() != "service" {
+		t.Errorf("allowed client got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, requestFrom("10.0.0.2"))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Nothing here") {
+		t.Errorf("denied client got %d %q, want 404 with the deny message", w.Code, w.Body.String())
+	}
+}
+
+// the global lists are checked first, so a service's rules can only narrow down who reaches it
+func TestAccessListWithGlobalLists(t *testing.T) {
+	viper.Set("blacklist", []string{"10.0.0.66"})
+	viper.Set("whitelist", []string{"10.0.0.0/8", "192.0.2.0/24"})
+	t.Cleanup(viper.Reset)
+
+	access := newTestMiddleware(t, NewAccessList, map[string]any{
+		"default":    "deny",
+		"denystatus": http.StatusNotFound,
+		"rules":      []any{map[string]any{"allow": []any{"10.0.0.0/8", "198.51.100.1"}}},
+	})
+	handler := BlacklistMiddleware(WhitelistMiddleware(access.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+
+	tests := []struct {
+		name       string
+		client     string
+		wantStatus int
+	}{
+		{"allowed everywhere", "10.0.0.1", http.StatusOK},
+		{"blacklisted but allowed by the service", "10.0.0.66", http.StatusForbidden},
+		{"whitelisted but denied by the service", "192.0.2.1", http.StatusNotFound},
+		{"allowed by the service but not whitelisted", "198.51.100.1", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, requestFrom(tt.client))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
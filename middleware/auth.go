@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// key used to mark the context of a request whose credentials were checked by interchange
+type authenticatedKey struct{}
+
+// marks a request as authenticated. Credentials are often removed before the request reaches the upstream, so this
+// is how shared caches know the response may be for that client alone
+func markAuthenticated(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authenticatedKey{}, true))
+}
+
+// reports whether interchange checked the credentials of a request with its auth, jwt or forwardAuth middleware
+func Authenticated(r *http.Request) bool {
+	authenticated, _ := r.Context().Value(authenticatedKey{}).(bool)
+	return authenticated
+}
+
+// returns the token of an Authorization header using the Bearer scheme, whose name is case-insensitive
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimLeft(token, " "), true
+}
+
+// requires requests to a service to carry valid credentials, either a username and password checked against an
+// htpasswd file, a bearer token or an API key in a header. Credential files are reloaded whenever they change
+type Authenticator struct {
+	kind  string
+	realm string
+	// the header API keys are read from
+	header string
+	// the header the authenticated user's name is sent to the upstream in, if any
+	userHeader string
+	// whether the credentials are passed on to the upstream rather than removed from the request
+	forwardCredentials bool
+
+	users  *credentialFile[htpasswd]
+	tokens *credentialFile[tokenSet]
+}
+
+// creates an authenticator from a service's `auth` table. Credential files are watched for changes until ctx is
+// cancelled
+func NewAuthenticator(ctx context.Context, cfg *config.Table, name string) (*Authenticator, error) {
+	a := &Authenticator{
+		kind:               cfg.String("type", ""),
+		realm:              cfg.String("realm", name),
+		header:             cfg.String("header", "X-API-Key"),
+		userHeader:         cfg.String("userHeader", ""),
+		forwardCredentials: cfg.Bool("forwardCredentials", false),
+	}
+	htpasswdFile := cfg.String("htpasswdFile", "")
+	tokenFile := cfg.String("tokenFile", "")
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if strings.ContainsAny(a.realm, "\"\\") {
+		return nil, fmt.Errorf("auth realm must not contain quotes or backslashes")
+	}
+
+	var err error
+	switch a.kind {
+	case "basic":
+		if htpasswdFile == "" {
+			return nil, fmt.Errorf("auth htpasswdFile must be set when type is 'basic'")
+		}
+		a.users, err = loadCredentialFile(ctx, htpasswdFile, parseHtpasswd)
+	case "bearer", "apiKey":
+		if tokenFile == "" {
+			return nil, fmt.Errorf("auth tokenFile must be set when type is '%s'", a.kind)
+		}
+		a.tokens, err = loadCredentialFile(ctx, tokenFile, parseTokens)
+	default:
+		return nil, fmt.Errorf("invalid auth type '%s', must be 'basic', 'bearer' or 'apiKey'", a.kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// checks the credentials of a request, returning the name of the user or token they belong to. The reason is used
+// in the error sent to the client when the credentials are invalid
+func (a *Authenticator) authenticate(r *http.Request) (user string, ok bool, reason string) {
+	switch a.kind {
+	case "basic":
+		user, password, found := r.BasicAuth()
+		if !found {
+			return "", false, ""
+		}
+		if !a.users.get().verify(user, password) {
+			return "", false, "invalid_credentials"
+		}
+		return user, true, ""
+	case "bearer":
+		token, found := bearerToken(r)
+		if !found || token == "" {
+			return "", false, ""
+		}
+		name, exists := a.tokens.get().lookup(token)
+		if !exists {
+			return "", false, "invalid_token"
+		}
+		return name, true, ""
+	default:
+		key := r.Header.Get(a.header)
+		if key == "" {
+			return "", false, ""
+		}
+		name, exists := a.tokens.get().lookup(key)
+		if !exists {
+			return "", false, "invalid_key"
+		}
+		return name, true, ""
+	}
+}
+
+// returns the WWW-Authenticate challenge sent with a 401
+func (a *Authenticator) challenge(reason string) string {
+	switch a.kind {
+	case "basic":
+		return fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, a.realm)
+	case "bearer":
+		if reason != "" {
+			return fmt.Sprintf(`Bearer realm="%s", error="%s"`, a.realm, reason)
+		}
+		return fmt.Sprintf(`Bearer realm="%s"`, a.realm)
+	default:
+		// API keys have no registered scheme, so the header to send the key in is named for clients to discover
+		return fmt.Sprintf(`APIKey realm="%s", header="%s"`, a.realm, a.header)
+	}
+}
+
+// returns middleware that turns away requests without valid credentials with a 401
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// the header is only ever set by interchange so clients can't claim to be someone else
+		if a.userHeader != "" {
+			r.Header.Del(a.userHeader)
+		}
+
+		user, ok, reason := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", a.challenge(reason))
+			templates.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		if !a.forwardCredentials {
+			if a.kind == "apiKey" {
+				r.Header.Del(a.header)
+			} else {
+				r.Header.Del("Authorization")
+			}
+		}
+		if a.userHeader != "" && user != "" {
+			r.Header.Set(a.userHeader, user)
+		}
+
+		next.ServeHTTP(w, markAuthenticated(r))
+	}
+
+	return http.HandlerFunc(fn)
+}
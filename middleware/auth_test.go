@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// returns an argon2id hash of password in the PHC string format with the given parameters
+func argon2PHC(password string, memory, time uint32, threads uint8) string {
+	salt := []byte("somesalt")
+	key := argon2.IDKey([]byte(password), salt, max(time, 1), max(memory, 8), max(threads, 1), 32)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{"bcrypt", "alice:" + bcryptHash(t, "secret"), false},
+		{"argon2id", "alice:" + argon2PHC("secret", 64, 1, 1), false},
+		{"comments and blank lines", "# users\n\nalice:" + bcryptHash(t, "secret") + "\n", false},
+		{"no passes", "alice:" + argon2PHC("secret", 64, 0, 1), true},
+		{"no threads", "alice:" + argon2PHC("secret", 64, 1, 0), true},
+		{"too little memory", "alice:" + argon2PHC("secret", 4, 1, 1), true},
+		{"unknown argon2 variant", "alice:$argon2d$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA", true},
+		{"old argon2 version", "alice:$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA", true},
+		{"argon2 without a hash", "alice:$argon2id$v=19$m=64,t=1,p=1$c2FsdA$", true},
+		{"truncated bcrypt", "alice:$2y$10$abc", true},
+		{"md5", "alice:$apr1$salt$hash", true},
+		{"no hash", "alice", true},
+		{"no user", ":" + bcryptHash(t, "secret"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseHtpasswd([]byte(tt.file))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	users, err := parseHtpasswd([]byte(fmt.Sprintf("alice:%s\nbob:%s\n", bcryptHash(t, "alice's"), argon2PHC("bob's", 64, 1, 1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "alice's", true},
+		{"alice", "alice's", true},
+		{"alice", "bob's", false},
+		{"bob", "bob's", true},
+		{"bob", "alice's", false},
+		{"carol", "alice's", false},
+	}
+
+	for _, tt := range tests {
+		if got := users.verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("verify(%s, %s) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := parseTokens([]byte("# tokens\nci:token-one\ntoken-two\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token      string
+		wantName   string
+		wantExists bool
+	}{
+		{"token-one", "ci", true},
+		{"token-two", "", true},
+		{"token-three", "", false},
+		{"ci:token-one", "", false},
+	}
+
+	for _, tt := range tests {
+		name, exists := tokens.lookup(tt.token)
+		if name != tt.wantName || exists != tt.wantExists {
+			t.Errorf("lookup(%s) = %q, %v, want %q, %v", tt.token, name, exists, tt.wantName, tt.wantExists)
+		}
+	}
+
+	if _, err := parseTokens([]byte("ci:\n")); err == nil {
+		t.Error("expected an error for an empty token")
+	}
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "htpasswd"), []byte("alice:"+bcryptHash(t, "secret")), 0o600)
+	os.WriteFile(filepath.Join(dir, "tokens"), []byte("ci:token-one\n"), 0o600)
+
+	tests := []struct {
+		name       string
+		cfg        map[string]any
+		header     http.Header
+		wantStatus int
+		wantUser   string
+	}{
+		{"basic", map[string]any{"type": "basic"}, http.Header{"Authorization": {"Basic YWxpY2U6c2VjcmV0"}}, http.StatusOK, "alice"},
+		{"basic with a wrong password", map[string]any{"type": "basic"}, http.Header{"Authorization": {"Basic YWxpY2U6d3Jvbmc="}}, http.StatusUnauthorized, ""},
+		{"basic without credentials", map[string]any{"type": "basic"}, http.Header{}, http.StatusUnauthorized, ""},
+		{"bearer", map[string]any{"type": "bearer"}, http.Header{"Authorization": {"Bearer token-one"}}, http.StatusOK, "ci"},
+		{"bearer scheme is case-insensitive", map[string]any{"type": "bearer"}, http.Header{"Authorization": {"bearer token-one"}}, http.StatusOK, "ci"},
+		{"bearer with an unknown token", map[string]any{"type": "bearer"}, http.Header{"Authorization": {"Bearer token-two"}}, http.StatusUnauthorized, ""},
+		{"bearer with another scheme", map[string]any{"type": "bearer"}, http.Header{"Authorization": {"Token token-one"}}, http.StatusUnauthorized, ""},
+		{"api key", map[string]any{"type": "apiKey"}, http.Header{"X-Api-Key": {"token-one"}}, http.StatusOK, "ci"},
+		{"api key can't set the user", map[string]any{"type": "apiKey"}, http.Header{"X-Api-Key": {"token-one"}, "X-User": {"admin"}}, http.StatusOK, "ci"},
+		{"made up user without credentials", map[string]any{"type": "apiKey"}, http.Header{"X-User": {"admin"}}, http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg["htpasswdfile"] = filepath.Join(dir, "htpasswd")
+			tt.cfg["tokenfile"] = filepath.Join(dir, "tokens")
+			tt.cfg["userheader"] = "X-User"
+			auth := newTestMiddleware(t, forService(t, NewAuthenticator), tt.cfg)
+
+			var upstream *http.Request
+			handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if w.Header().Get("WWW-Authenticate") == "" {
+					t.Error("401 was sent without a challenge")
+				}
+				return
+			}
+
+			if got := upstream.Header.Get("X-User"); got != tt.wantUser {
+				t.Errorf("user = %q, want %q", got, tt.wantUser)
+			}
+			if upstream.Header.Get("Authorization") != "" || upstream.Header.Get("X-Api-Key") != "" {
+				t.Error("credentials were passed on to the upstream")
+			}
+			if !Authenticated(upstream) {
+				t.Error("request wasn't marked as authenticated")
+			}
+		})
+	}
+}
+
+func TestCredentialFileKeepsPreviousOnInvalidReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(path, []byte("alice:"+bcryptHash(t, "secret")), 0o600)
+	users, err := loadCredentialFile(t.Context(), path, parseHtpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// argon2 would panic with no threads, so the file must be rejected rather than loaded
+	os.WriteFile(path, []byte("alice:"+argon2PHC("secret", 64, 1, 0)), 0o600)
+	if err := users.load(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !users.get().verify("alice", "secret") {
+		t.Error("previous credentials weren't kept")
+	}
+}
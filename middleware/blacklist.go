@@ -1,30 +1,35 @@
 package middleware
 
 import (
+	"log/slog"
 	"net/http"
-	"strings"
 
 	"github.com/grqphical/interchange/templates"
 	"github.com/spf13/viper"
 )
 
+// returns the named groups of addresses that lists can reference as "@name"
+func ipGroups() map[string][]string {
+	return viper.GetStringMapStringSlice("ipGroups")
+}
+
+// parses a global address list, logging any invalid entries. The valid entries are still used
+func globalIPSet(key string) *IPSet {
+	set, err := ParseIPSet(viper.GetStringSlice(key), ipGroups())
+	if err != nil {
+		slog.Error("ConfigurationError", "err", err.Error()+" in "+key)
+	}
+	return set
+}
+
 func BlacklistMiddleware(next http.Handler) http.Handler {
-	blacklist := viper.GetStringSlice("blacklist")
+	blacklist := globalIPSet("blacklist")
 
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if len(blacklist) == 0 {
-			next.ServeHTTP(w, r)
+		if blacklist.Contains(ClientIP(r)) {
+			templates.WriteError(w, http.StatusForbidden, "Forbidden")
 			return
 		}
-		for _, listIP := range blacklist {
-			remoteIPAndPort := r.RemoteAddr
-			remoteIP := strings.Split(remoteIPAndPort, ":")[0]
-
-			if remoteIP == listIP {
-				templates.WriteError(w, http.StatusForbidden, "Forbidden")
-				return
-			}
-		}
 
 		next.ServeHTTP(w, r)
 	}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+// key used to store the clientInfo of a request in its context
+type clientInfoKey struct{}
+
+// who sent a request, resolved once when it arrives
+type clientInfo struct {
+	addr netip.Addr
+	// the client's port, only known when it connected to interchange directly
+	port uint16
+	// the addresses the request passed through, from the client to the peer that connected to interchange. It only
+	// holds more than the peer if the peer is a trusted proxy
+	chain []string
+	// set when the peer is a trusted proxy, whose forwarding headers can be believed
+	viaTrustedProxy bool
+}
+
+// resolves the address of the client that sent a request. The X-Forwarded-For and X-Real-IP headers are only believed
+// when the request comes from one of the `trustedProxies`, in which case the client is the right-most address in
+// X-Forwarded-For that isn't a trusted proxy itself, since anything to the left of it could have been made up by the
+// client. The address is only stored in the request's context, RemoteAddr is left as the peer that connected to
+// interchange
+func ClientIPMiddleware(next http.Handler) http.Handler {
+	trusted := globalIPSet("trustedProxies")
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		info := resolveClient(r, trusted)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info)))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func resolveClient(r *http.Request, trusted *IPSet) *clientInfo {
+	peer := remoteAddr(r)
+	info := &clientInfo{addr: peer.Addr(), port: peer.Port(), chain: []string{peer.Addr().String()}}
+	if !trusted.Contains(peer.Addr()) {
+		return info
+	}
+	info.viaTrustedProxy = true
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+			hops = []string{realIP}
+		}
+	}
+
+	// walk back from the peer until reaching an address that isn't a trusted proxy
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// a garbled hop can't be trusted, so the last proxy that added a valid address is taken as the client
+			break
+		}
+		info.addr = addr.Unmap()
+		info.port = 0
+		info.chain = append([]string{info.addr.String()}, info.chain...)
+		if !trusted.Contains(addr) {
+			break
+		}
+	}
+
+	return info
+}
+
+// returns the client's information stored by ClientIPMiddleware, resolving it without any trusted proxies if the
+// middleware hasn't run
+func client(r *http.Request) *clientInfo {
+	if info, ok := r.Context().Value(clientInfoKey{}).(*clientInfo); ok {
+		return info
+	}
+	return resolveClient(r, nil)
+}
+
+// returns the address of the client that sent the request
+func ClientIP(r *http.Request) netip.Addr {
+	return client(r).addr
+}
+
+// returns the address and port of the client that sent the request a context belongs to. The port is 0 if the
+// request came through a trusted proxy, and false is returned if ClientIPMiddleware hasn't handled the request
+func ClientAddrFromContext(ctx context.Context) (netip.AddrPort, bool) {
+	info, ok := ctx.Value(clientInfoKey{}).(*clientInfo)
+	if !ok || !info.addr.IsValid() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(info.addr, info.port), true
+}
+
+// returns the value of the X-Forwarded-For header for a request that is being forwarded on, listing the client and
+// any trusted proxies the request passed through
+func ForwardedFor(r *http.Request) string {
+	return strings.Join(client(r).chain, ", ")
+}
+
+// reports whether the request came through a trusted proxy, meaning forwarding headers such as X-Forwarded-Proto
+// set by it can be believed
+func FromTrustedProxy(r *http.Request) bool {
+	return client(r).viaTrustedProxy
+}
+
+// formats the request log like chi's default formatter, but with the client resolved by ClientIPMiddleware in place of
+// the peer that connected to interchange
+type clientLogFormatter struct {
+	chimiddleware.LogFormatter
+}
+
+func (f clientLogFormatter) NewLogEntry(r *http.Request) chimiddleware.LogEntry {
+	if info, ok := r.Context().Value(clientInfoKey{}).(*clientInfo); ok && info.viaTrustedProxy && info.addr.IsValid() {
+		// the formatter only reads the request, so a shallow copy is enough to leave the original untouched
+		logged := *r
+		logged.RemoteAddr = netip.AddrPortFrom(info.addr, info.port).String()
+		r = &logged
+	}
+	return f.LogFormatter.NewLogEntry(r)
+}
+
+// logs each request along with the client that sent it. It must come after ClientIPMiddleware
+var RequestLogger = chimiddleware.RequestLogger(clientLogFormatter{&chimiddleware.DefaultLogFormatter{
+	Logger:  log.New(os.Stdout, "", log.LstdFlags),
+	NoColor: runtime.GOOS == "windows",
+}})
+
+// returns the address and port of the peer that connected to interchange, or an invalid address if it can't be parsed
+func remoteAddr(r *http.Request) netip.AddrPort {
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap().WithZone(""), addrPort.Port())
+	}
+	addr, _ := netip.ParseAddr(r.RemoteAddr)
+	return netip.AddrPortFrom(addr.Unmap(), 0)
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestClientIPMiddleware(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set("trustedProxies", []string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  string
+		realIP        string
+		wantClient    string
+		wantForwarded string
+	}{
+		{"direct client", "192.0.2.1:1234", "", "", "192.0.2.1", "192.0.2.1"},
+		{"untrusted peer's headers are ignored", "192.0.2.1:1234", "198.51.100.1", "", "192.0.2.1", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1", "198.51.100.1, 10.0.0.1"},
+		{"made up hops are skipped", "10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "", "198.51.100.1", "198.51.100.1, 10.0.0.2, 10.0.0.1"},
+		{"X-Real-IP without X-Forwarded-For", "10.0.0.1:1234", "", "198.51.100.1", "198.51.100.1", "198.51.100.1, 10.0.0.1"},
+		{"garbled hop", "10.0.0.1:1234", "198.51.100.1, garbage, 10.0.0.2", "", "10.0.0.2", "10.0.0.2, 10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			var got *http.Request
+			ClientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if client := ClientIP(got).String(); client != tt.wantClient {
+				t.Errorf("client = %s, want %s", client, tt.wantClient)
+			}
+			if forwarded := ForwardedFor(got); forwarded != tt.wantForwarded {
+				t.Errorf("X-Forwarded-For = %q, want %q", forwarded, tt.wantForwarded)
+			}
+			if got.RemoteAddr != tt.remoteAddr {
+				t.Errorf("RemoteAddr = %s, want it left as %s", got.RemoteAddr, tt.remoteAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// a request waiting in the queue of a ConcurrencyLimiter
+type waiter struct {
+	ready chan struct{}
+	// set before ready is closed, true if the request was given a slot and false if it was turned away
+	admitted bool
+}
+
+// limits how many requests a service handles at once. Requests over the limit wait in a bounded queue for a slot to
+// free up, with requests in higher priority classes taking slots first
+type ConcurrencyLimiter struct {
+	maxConcurrent int
+	queueSize     int
+	timeout       time.Duration
+	retryAfter    time.Duration
+
+	// the header naming the priority class of a request, and its values from the highest priority to the lowest.
+	// Requests without one of the values are in the lowest class
+	priorityHeader string
+	priorities     []string
+
+	mu     sync.Mutex
+	active int
+	// a queue for each priority class, highest priority first
+	queues   [][]*waiter
+	queued   int
+	rejected int64
+}
+
+// creates a limiter allowing maxConcurrent requests at once, with its queue configured by a `queue` table
+func NewConcurrencyLimiter(maxConcurrent int, cfg *config.Table) (*ConcurrencyLimiter, error) {
+	l := &ConcurrencyLimiter{
+		maxConcurrent:  maxConcurrent,
+		queueSize:      cfg.Int("size", 0),
+		timeout:        cfg.Duration("timeout", 10*time.Second),
+		retryAfter:     cfg.Duration("retryAfter", time.Second),
+		priorityHeader: cfg.String("priorityHeader", ""),
+		priorities:     cfg.StringSlice("priorities"),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if maxConcurrent < 1 {
+		return nil, fmt.Errorf("maxConcurrent must be at least 1")
+	}
+	if l.queueSize < 0 || l.timeout <= 0 || l.retryAfter < 0 {
+		return nil, fmt.Errorf("queue size must not be negative and timeout must be positive")
+	}
+	if len(l.priorities) > 0 && l.priorityHeader == "" {
+		return nil, fmt.Errorf("queue priorityHeader must be set along with priorities")
+	}
+
+	l.queues = make([][]*waiter, len(l.priorities)+1)
+	return l, nil
+}
+
+// returns the index of the priority class of a request, with 0 being the highest priority
+func (l *ConcurrencyLimiter) class(r *http.Request) int {
+	if l.priorityHeader != "" {
+		if i := slices.Index(l.priorities, r.Header.Get(l.priorityHeader)); i >= 0 {
+			return i
+		}
+	}
+	return len(l.priorities)
+}
+
+// waits for a slot for the request, returning false if it was turned away because the queue was full, it waited for
+// longer than the timeout or the client went away
+func (l *ConcurrencyLimiter) acquire(r *http.Request) bool {
+	l.mu.Lock()
+	if l.active < l.maxConcurrent && l.queued == 0 {
+		l.active++
+		l.mu.Unlock()
+		return true
+	}
+
+	// requests in a priority class wait for the next free slot even if the queue is full and there is nobody below
+	// them to turn away, so a busy service can't lock them out
+	class := l.class(r)
+	if l.queued >= l.queueSize && !l.evict(class) && class == len(l.priorities) {
+		l.rejected++
+		l.mu.Unlock()
+		return false
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	l.queues[class] = append(l.queues[class], w)
+	l.queued++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.admitted
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the request may have been given a slot or turned away while the timer fired
+	if i := slices.Index(l.queues[class], w); i >= 0 {
+		l.queues[class] = slices.Delete(l.queues[class], i, i+1)
+		l.queued--
+		l.rejected++
+		return false
+	}
+	return w.admitted
+}
+
+// makes room in a full queue for a request of the given class by turning away the most recently queued request of
+// the lowest class below it. It must be called with l.mu held
+func (l *ConcurrencyLimiter) evict(class int) bool {
+	for lower := len(l.queues) - 1; lower > class; lower-- {
+		queue := l.queues[lower]
+		if len(queue) == 0 {
+			continue
+		}
+
+		w := queue[len(queue)-1]
+		l.queues[lower] = queue[:len(queue)-1]
+		l.queued--
+		l.rejected++
+		close(w.ready)
+		return true
+	}
+	return false
+}
+
+// frees the slot of a finished request, handing it to the first queued request of the highest priority class
+func (l *ConcurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for class, queue := range l.queues {
+		if len(queue) == 0 {
+			continue
+		}
+
+		w := queue[0]
+		l.queues[class] = queue[1:]
+		l.queued--
+		w.admitted = true
+		close(w.ready)
+		return
+	}
+	l.active--
+}
+
+// returns the limiter's state for the debug endpoint
+func (l *ConcurrencyLimiter) DebugInfo() map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return map[string]any{
+		"concurrency": map[string]any{
+			"maxConcurrent": l.maxConcurrent,
+			"active":        l.active,
+			"queued":        l.queued,
+			"queueSize":     l.queueSize,
+			"rejected":      l.rejected,
+		},
+	}
+}
+
+// returns middleware that applies the limit to the requests it handles
+func (l *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			// the client went away so there is nobody to send an error page to
+			if r.Context().Err() != nil {
+				return
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(l.retryAfter))))
+			templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		defer l.release()
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
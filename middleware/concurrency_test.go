@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// builds a limiter with a single slot
+func newSingleSlotLimiter(queue *config.Table) (*ConcurrencyLimiter, error) {
+	return NewConcurrencyLimiter(1, queue)
+}
+
+func requestWithPriority(priority string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if priority != "" {
+		r.Header.Set("X-Priority", priority)
+	}
+	return r
+}
+
+// queues a request for each priority in turn while the only slot is taken, waiting until each is queued so they
+// arrive in order. It returns a channel per request that receives whether it was given a slot
+func queueRequests(t *testing.T, l *ConcurrencyLimiter, priorities []string) []chan bool {
+	t.Helper()
+	results := make([]chan bool, len(priorities))
+	for i, priority := range priorities {
+		results[i] = make(chan bool, 1)
+		go func() { results[i] <- l.acquire(requestWithPriority(priority)) }()
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			l.mu.Lock()
+			handled := l.queued + int(l.rejected)
+			l.mu.Unlock()
+			if handled > i {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("request %d was never queued", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return results
+}
+
+func TestNewConcurrencyLimiterErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxConcurrent int
+		queue         map[string]any
+	}{
+		{"no slots", 0, map[string]any{}},
+		{"negative queue size", 1, map[string]any{"size": -1}},
+		{"zero timeout", 1, map[string]any{"timeout": "0s"}},
+		{"priorities without a header", 1, map[string]any{"priorities": []any{"admin"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewConcurrencyLimiter(tt.maxConcurrent, config.NewTable(tt.queue)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		priorities []string
+		// the order queued requests are given the slot in, by their index, or -1 if they were turned away
+		want []int
+	}{
+		{"first come first served", 3, []string{"", "", ""}, []int{0, 1, 2}},
+		{"higher classes first", 3, []string{"", "admin", "health"}, []int{2, 1, 0}},
+		{"full queue turns requests away", 1, []string{"", ""}, []int{0, -1}},
+		{"priority evicts the latest lower request", 2, []string{"", "", "admin"}, []int{1, -1, 0}},
+		{"priority evicts the lowest class first", 2, []string{"admin", "", "health"}, []int{1, -1, 0}},
+		{"priority waits even when the queue is empty", 0, []string{"", "admin", "admin"}, []int{-1, 0, 1}},
+		{"priority waits beyond a full queue without evicting its own class", 1, []string{"admin", "admin", ""}, []int{0, 1, -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestMiddleware(t, newSingleSlotLimiter, map[string]any{
+				"size":           tt.size,
+				"priorityheader": "X-Priority",
+				"priorities":     []any{"health", "admin"},
+			})
+			if !l.acquire(requestWithPriority("")) {
+				t.Fatal("first request wasn't given the free slot")
+			}
+			results := queueRequests(t, l, tt.priorities)
+
+			got := make([]int, len(results))
+			for i := range got {
+				got[i] = -1
+			}
+			for order := 0; ; order++ {
+				l.release()
+				admitted := -1
+				for i, result := range results {
+					select {
+					case ok := <-result:
+						if ok {
+							got[i] = order
+							admitted = i
+						}
+					case <-time.After(20 * time.Millisecond):
+					}
+				}
+				if admitted < 0 {
+					break
+				}
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("request %d (%q) admitted at %d, want %d", i, tt.priorities[i], got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	l := newTestMiddleware(t, newSingleSlotLimiter, map[string]any{
+		"size":           1,
+		"timeout":        "10ms",
+		"priorityheader": "X-Priority",
+		"priorities":     []any{"health", "admin"},
+	})
+	l.acquire(requestWithPriority(""))
+
+	if l.acquire(requestWithPriority("health")) {
+		t.Error("request was given a slot that was never freed")
+	}
+	l.release()
+
+	info := l.DebugInfo()["concurrency"].(map[string]any)
+	if info["active"] != 0 || info["queued"] != 0 || info["rejected"] != int64(1) {
+		t.Errorf("limiter state = %v", info)
+	}
+}
@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the number of verified passwords remembered so bcrypt and argon2, which are slow on purpose, don't run on every
+// request from a client that has already logged in
+const maxVerifiedPasswords = 1024
+
+// how long a credential file must go unchanged before it is reloaded
+const credentialReloadDelay = 100 * time.Millisecond
+
+// a file of credentials that is parsed again whenever it changes on disk
+type credentialFile[T any] struct {
+	path  string
+	parse func([]byte) (*T, error)
+	value atomic.Pointer[T]
+}
+
+// loads a credential file and keeps it up to date until ctx is cancelled. The file's directory is watched rather than
+// the file itself so editors and tools that replace the file instead of writing to it are picked up. If the file
+// becomes invalid the previous credentials are kept
+func loadCredentialFile[T any](ctx context.Context, path string, parse func([]byte) (*T, error)) (*credentialFile[T], error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &credentialFile[T]{path: path, parse: parse}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		// writing a file usually truncates it first, so the file is only read once changes have stopped to avoid
+		// loading it while it is empty
+		debounce := time.NewTimer(0)
+		<-debounce.C
+		for {
+			select {
+			case <-ctx.Done():
+				debounce.Stop()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Has(fsnotify.Write|fsnotify.Create) {
+					debounce.Reset(credentialReloadDelay)
+				}
+			case <-debounce.C:
+				if err := f.load(); err != nil {
+					slog.Error(fmt.Sprintf("failed to reload credentials from '%s', keeping the previous ones", path), "err", err)
+					continue
+				}
+				slog.Info(fmt.Sprintf("reloaded credentials from '%s'", path))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error(fmt.Sprintf("failed to watch '%s' for changes", path), "err", err)
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+func (f *credentialFile[T]) load() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("%s in '%s'", err, f.path)
+	}
+	f.value.Store(value)
+	return nil
+}
+
+// returns the most recently loaded credentials
+func (f *credentialFile[T]) get() *T {
+	return f.value.Load()
+}
+
+// calls fn with the number and content of each line in a credential file, skipping blank lines and comments
+func eachCredentialLine(data []byte, fn func(n int, line string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// the users in an htpasswd file
+type htpasswd struct {
+	hashes map[string]string
+
+	mu sync.Mutex
+	// hashes of the user, password and password hash of recent successful logins
+	verified map[[32]byte]struct{}
+}
+
+// parses an htpasswd file of `user:hash` lines. Only bcrypt and argon2 hashes are accepted as the older formats
+// htpasswd supports can be cracked easily, and a file with a malformed hash is rejected as a whole
+func parseHtpasswd(data []byte) (*htpasswd, error) {
+	h := &htpasswd{hashes: map[string]string{}, verified: map[[32]byte]struct{}{}}
+	err := eachCredentialLine(data, func(n int, line string) error {
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return fmt.Errorf("line %d is not in the form user:hash", n)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$2"):
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return fmt.Errorf("user '%s' on line %d has an invalid bcrypt hash", user, n)
+			}
+		case strings.HasPrefix(hash, "$argon2"):
+			if _, err := parseArgon2Hash(hash); err != nil {
+				return fmt.Errorf("user '%s' on line %d: %s", user, n, err)
+			}
+		default:
+			return fmt.Errorf("user '%s' on line %d must use a bcrypt or argon2 hash", user, n)
+		}
+		h.hashes[user] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reports whether the password is correct for the user
+func (h *htpasswd) verify(user, password string) bool {
+	hash, exists := h.hashes[user]
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+
+	h.mu.Lock()
+	_, verified := h.verified[key]
+	h.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if !exists {
+		// compared against a made up hash so unknown users take as long to reject as wrong passwords
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return false
+	}
+	if !verifyPasswordHash(hash, password) {
+		return false
+	}
+
+	h.mu.Lock()
+	if len(h.verified) >= maxVerifiedPasswords {
+		clear(h.verified)
+	}
+	h.verified[key] = struct{}{}
+	h.mu.Unlock()
+	return true
+}
+
+// returns a bcrypt hash to check the passwords of users that don't exist against. It is only generated when first
+// needed as hashing is slow
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("interchange"), bcrypt.DefaultCost)
+	return hash
+})
+
+// the parameters and output of an argon2 hash
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parses an argon2 hash in the PHC string format, such as `$argon2id$v=19$m=65536,t=3,p=4$salt$hash`. The
+// parameters are checked as argon2 panics if it is run with no passes or threads
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("argon2 hash is not in the PHC string format")
+	}
+
+	h := &argon2Hash{variant: parts[1]}
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return nil, fmt.Errorf("unsupported argon2 variant '%s'", h.variant)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("argon2 hash must be version %d", argon2.Version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2 parameters '%s'", parts[3])
+	}
+	if h.time < 1 || h.threads < 1 || h.memory < 8*uint32(h.threads) {
+		return nil, fmt.Errorf("argon2 parameters '%s' need at least one pass, one thread and 8KiB of memory per thread", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2 salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+	return h, nil
+}
+
+// checks a password against a bcrypt hash or an argon2 hash in the PHC string format
+func verifyPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+
+	var actual []byte
+	if h.variant == "argon2id" {
+		actual = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		actual = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(actual, h.key) == 1
+}
+
+// the tokens in a token file, stored by their hash so looking one up doesn't leak how much of it matched
+type tokenSet struct {
+	names map[[32]byte]string
+}
+
+// parses a file of tokens, one per line. A token may be given a name, written as `name:token`, which identifies the
+// client in the upstream request
+func parseTokens(data []byte) (*tokenSet, error) {
+	t := &tokenSet{names: map[[32]byte]string{}}
+	err := eachCredentialLine(data, func(n int, line string) error {
+		name, token, found := strings.Cut(line, ":")
+		if !found {
+			name, token = "", line
+		}
+		if token == "" {
+			return fmt.Errorf("line %d has an empty token", n)
+		}
+		t.names[sha256.Sum256([]byte(token))] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// returns the name of a token and whether it is in the set
+func (t *tokenSet) lookup(token string) (string, bool) {
+	name, exists := t.names[sha256.Sum256([]byte(token))]
+	return name, exists
+}
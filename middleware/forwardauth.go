@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// the largest response body from an auth server that is passed back to the client
+const forwardAuthBodyLimit = 64 << 10
+
+// headers that only apply to a single connection, which aren't sent to the auth server or passed back from it
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade",
+}
+
+// the response of an auth server to a request it turned away
+type forwardAuthDenial struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// an auth server's decision on a request, remembered for a while when caching is enabled
+type forwardAuthDecision struct {
+	// the headers copied into the request when it is allowed, or nil if it was denied
+	allowed http.Header
+	denial  *forwardAuthDenial
+	expires time.Time
+}
+
+// asks an external auth server whether each request should be let through, like nginx's auth_request. The auth
+// server is sent the request's method, URI and headers without its body. A 2xx response lets the request through,
+// copying the chosen headers into it, while any other response apart from a server error is passed back to the client
+type ForwardAuth struct {
+	address         string
+	client          *http.Client
+	responseHeaders []string
+
+	cacheTTL        time.Duration
+	maxCacheEntries int
+
+	mu    sync.Mutex
+	cache map[[32]byte]*forwardAuthDecision
+}
+
+// creates a forward auth check from a service's `forwardAuth` table
+func NewForwardAuth(cfg *config.Table) (*ForwardAuth, error) {
+	a := &ForwardAuth{
+		address:         cfg.String("address", ""),
+		responseHeaders: cfg.StringSlice("responseHeaders"),
+		cacheTTL:        cfg.Duration("cacheTTL", 0),
+		maxCacheEntries: cfg.Int("maxCacheEntries", 10000),
+		cache:           map[[32]byte]*forwardAuthDecision{},
+	}
+	timeout := cfg.Duration("timeout", 5*time.Second)
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(a.address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("forwardAuth address must be an http or https URL")
+	}
+	if timeout <= 0 || a.cacheTTL < 0 || a.maxCacheEntries < 1 {
+		return nil, fmt.Errorf("forwardAuth timeout and maxCacheEntries must be positive and cacheTTL must not be negative")
+	}
+
+	a.client = &http.Client{
+		Timeout: timeout,
+		// redirects, such as to a login page, are passed back to the client rather than followed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return a, nil
+}
+
+// returns the key of the cache entry for the decision on a subrequest, made up of its method and every header sent to
+// the auth server. That includes the original URI and the client's address along with any headers set by `auth` or
+// `jwt`, which may have removed the credentials, so a decision is only reused for requests the auth server couldn't
+// tell apart
+func forwardAuthCacheKey(req *http.Request) [32]byte {
+	var key strings.Builder
+	key.WriteString(req.Method)
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		// header values can't contain control characters, so they can't be mistaken for the separators
+		key.WriteString("\x01" + name)
+		for _, value := range req.Header[name] {
+			key.WriteString("\x00" + value)
+		}
+	}
+	return sha256.Sum256([]byte(key.String()))
+}
+
+func (a *ForwardAuth) cached(key [32]byte, now time.Time) *forwardAuthDecision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	decision, exists := a.cache[key]
+	if !exists || now.After(decision.expires) {
+		return nil
+	}
+	return decision
+}
+
+func (a *ForwardAuth) store(key [32]byte, decision *forwardAuthDecision, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cache) >= a.maxCacheEntries {
+		maps.DeleteFunc(a.cache, func(_ [32]byte, d *forwardAuthDecision) bool {
+			return now.After(d.expires)
+		})
+		// still full of decisions that haven't expired, so start again rather than let the cache grow
+		if len(a.cache) >= a.maxCacheEntries {
+			clear(a.cache)
+		}
+	}
+	a.cache[key] = decision
+}
+
+// builds the subrequest sent to the auth server for a request
+func (a *ForwardAuth) subrequest(r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, a.address, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = r.Header.Clone()
+	for _, header := range append(hopByHopHeaders, "Content-Length", "Expect") {
+		req.Header.Del(header)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", ForwardedFor(r))
+	return req, nil
+}
+
+// asks the auth server about a request by sending it the subrequest
+func (a *ForwardAuth) decide(req *http.Request) (*forwardAuthDecision, error) {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		allowed := http.Header{}
+		for _, header := range a.responseHeaders {
+			if values := resp.Header.Values(header); len(values) > 0 {
+				allowed[http.CanonicalHeaderKey(header)] = values
+			}
+		}
+		return &forwardAuthDecision{allowed: allowed}, nil
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("auth server responded with %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, forwardAuthBodyLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > forwardAuthBodyLimit {
+		return nil, errors.New("auth server response is too large to pass back")
+	}
+
+	header := resp.Header.Clone()
+	for _, h := range append(hopByHopHeaders, "Content-Length") {
+		header.Del(h)
+	}
+	return &forwardAuthDecision{denial: &forwardAuthDenial{status: resp.StatusCode, header: header, body: body}}, nil
+}
+
+// returns middleware that checks every request with the auth server before it is handled
+func (a *ForwardAuth) Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// the headers are only ever set from the auth server's response so clients can't set them themselves
+		for _, header := range a.responseHeaders {
+			r.Header.Del(header)
+		}
+
+		req, err := a.subrequest(r)
+		if err != nil {
+			slog.Error(fmt.Sprintf("forward auth to '%s' failed for %s %s", a.address, r.Method, r.URL.Path), "err", err)
+			templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+
+		now := time.Now()
+		var key [32]byte
+		var decision *forwardAuthDecision
+		if a.cacheTTL > 0 {
+			key = forwardAuthCacheKey(req)
+			decision = a.cached(key, now)
+		}
+
+		if decision == nil {
+			decision, err = a.decide(req)
+			if err != nil {
+				// the client went away so there is nobody to send an error page to
+				if r.Context().Err() != nil {
+					return
+				}
+				slog.Error(fmt.Sprintf("forward auth to '%s' failed for %s %s", a.address, r.Method, r.URL.Path), "err", err)
+				templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+				return
+			}
+
+			// a denial that sets cookies is meant for one client, so it is never handed to another
+			if a.cacheTTL > 0 && (decision.denial == nil || len(decision.denial.header.Values("Set-Cookie")) == 0) {
+				decision.expires = now.Add(a.cacheTTL)
+				a.store(key, decision, now)
+			}
+		}
+
+		if denial := decision.denial; denial != nil {
+			// cloned as cached decisions are shared between requests
+			maps.Copy(w.Header(), denial.header.Clone())
+			w.WriteHeader(denial.status)
+			w.Write(denial.body)
+			return
+		}
+
+		for header, values := range decision.allowed {
+			r.Header[header] = slices.Clone(values)
+		}
+		next.ServeHTTP(w, markAuthenticated(r))
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// an auth server that allows requests carrying "Bearer good" or from the user "alice", denying everything else
+func newAuthServer(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch {
+		case r.Header.Get("X-Forwarded-Uri") == "/broken":
+			w.WriteHeader(http.StatusBadGateway)
+		case r.Header.Get("X-Forwarded-Uri") == "/login":
+			http.SetCookie(w, &http.Cookie{Name: "state", Value: "123"})
+			http.Redirect(w, r, "https://auth.example.com/login", http.StatusFound)
+		case r.Header.Get("Authorization") == "Bearer good" || r.Header.Get("X-User") == "alice":
+			w.Header().Set("X-User-ID", "42")
+			w.Header().Set("X-Internal", "secret")
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="app"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("go away"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewForwardAuthErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"no address", map[string]any{}},
+		{"address that isn't http", map[string]any{"address": "ftp://auth.example.com"}},
+		{"negative cache TTL", map[string]any{"address": "http://auth.example.com", "cachettl": "-1s"}},
+		{"no cache entries", map[string]any{"address": "http://auth.example.com", "maxcacheentries": 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewForwardAuth(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestForwardAuthMiddleware(t *testing.T) {
+	var calls atomic.Int32
+	server := newAuthServer(t, &calls)
+
+	tests := []struct {
+		name       string
+		target     string
+		header     http.Header
+		wantStatus int
+		wantUserID string
+	}{
+		{"allowed", "/", http.Header{"Authorization": {"Bearer good"}}, http.StatusOK, "42"},
+		{"client can't set the response headers", "/", http.Header{"Authorization": {"Bearer good"}, "X-User-Id": {"1"}}, http.StatusOK, "42"},
+		{"denied", "/", http.Header{"Authorization": {"Bearer bad"}}, http.StatusUnauthorized, ""},
+		{"denied with made up response headers", "/", http.Header{"X-User-Id": {"1"}}, http.StatusUnauthorized, ""},
+		{"redirect to log in", "/login", http.Header{}, http.StatusFound, ""},
+		{"auth server error", "/broken", http.Header{"Authorization": {"Bearer good"}}, http.StatusServiceUnavailable, ""},
+	}
+
+	servers := []struct {
+		name    string
+		address string
+	}{
+		{"reachable", server.URL},
+		{"unreachable", "http://127.0.0.1:1"},
+	}
+
+	for _, s := range servers {
+		auth := newTestMiddleware(t, NewForwardAuth, map[string]any{
+			"address":         s.address,
+			"responseheaders": []any{"X-User-ID"},
+		})
+		for _, tt := range tests {
+			t.Run(s.name+"/"+tt.name, func(t *testing.T) {
+				var upstream *http.Request
+				handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					upstream = r
+				}))
+				r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+				r.Header = tt.header
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				// an auth server that can't be reached turns every request away
+				wantStatus := tt.wantStatus
+				if s.address != server.URL {
+					wantStatus = http.StatusServiceUnavailable
+				}
+				if w.Code != wantStatus {
+					t.Fatalf("status = %d, want %d", w.Code, wantStatus)
+				}
+
+				switch wantStatus {
+				case http.StatusOK:
+					if got := upstream.Header.Get("X-User-ID"); got != tt.wantUserID {
+						t.Errorf("X-User-ID = %q, want %q", got, tt.wantUserID)
+					}
+					if upstream.Header.Get("X-Internal") != "" {
+						t.Error("a header that isn't in responseHeaders was copied into the request")
+					}
+					if !Authenticated(upstream) {
+						t.Error("request wasn't marked as authenticated")
+					}
+				case http.StatusUnauthorized:
+					if w.Body.String() != "go away" || w.Header().Get("WWW-Authenticate") == "" {
+						t.Errorf("denial wasn't passed back, got %q with %v", w.Body.String(), w.Header())
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	// requests after the first, with what they change about it and whether the decision can be reused
+	tests := []struct {
+		name       string
+		change     func(r *http.Request)
+		wantStatus int
+		wantCached bool
+	}{
+		{"same request", func(r *http.Request) {}, http.StatusOK, true},
+		{"different user set by auth", func(r *http.Request) { r.Header.Set("X-User", "bob") }, http.StatusUnauthorized, false},
+		{"different client", func(r *http.Request) { r.RemoteAddr = "192.0.2.2:1234" }, http.StatusOK, false},
+		{"different URI", func(r *http.Request) { r.URL.Path = "/other" }, http.StatusOK, false},
+		{"different method", func(r *http.Request) { r.Method = http.MethodPost }, http.StatusOK, false},
+		{"extra header", func(r *http.Request) { r.Header.Set("X-Tenant", "other") }, http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			auth := newTestMiddleware(t, NewForwardAuth, map[string]any{
+				"address":  newAuthServer(t, &calls).URL,
+				"cachettl": "1m",
+			})
+			handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			// auth has already swapped the credentials for the user's name
+			request := func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = "192.0.2.1:1234"
+				r.Header.Set("X-User", "alice")
+				return r
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request())
+
+			r := request()
+			tt.change(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if cached := calls.Load() == 1; cached != tt.wantCached {
+				t.Errorf("cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestForwardAuthDoesNotCacheDenialsSettingCookies(t *testing.T) {
+	var calls atomic.Int32
+	auth := newTestMiddleware(t, NewForwardAuth, map[string]any{
+		"address":  newAuthServer(t, &calls).URL,
+		"cachettl": "1m",
+	})
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/login", nil))
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("auth server was asked %d times, want 2", n)
+	}
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// an inclusive range of addresses
+type ipRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+// a set of IP addresses built from single addresses, CIDR prefixes and named groups. The entries are kept as sorted,
+// non overlapping ranges so looking up an address is a binary search however long the list is
+type IPSet struct {
+	ranges []ipRange
+}
+
+// returns the last address in a prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().As16()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		bytes[i/8] |= 1 << (7 - i%8)
+	}
+
+	addr := netip.AddrFrom16(bytes)
+	if prefix.Addr().Is4() {
+		addr = addr.Unmap()
+	}
+	return addr
+}
+
+// parses an address or CIDR prefix into the range it covers
+func parseIPRange(entry string) (ipRange, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("invalid CIDR prefix '%s'", entry)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefix = prefix.Masked()
+		return ipRange{prefix.Addr(), lastAddr(prefix)}, nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return ipRange{}, fmt.Errorf("invalid IP address '%s'", entry)
+	}
+	addr = addr.Unmap().WithZone("")
+	return ipRange{addr, addr}, nil
+}
+
+// builds a set from a list of addresses, CIDR prefixes, "all" and references to named groups written as "@name".
+// Groups may reference other groups. Every valid entry is added to the set even if others are invalid, in which case the
+// first error is returned along with the set
+func ParseIPSet(entries []string, groups map[string][]string) (*IPSet, error) {
+	s := &IPSet{}
+	var firstErr error
+	s.add(entries, groups, map[string]bool{}, &firstErr)
+
+	sort.Slice(s.ranges, func(i, j int) bool {
+		return s.ranges[i].first.Less(s.ranges[j].first)
+	})
+
+	// merge overlapping and adjacent ranges so at most one range can contain an address
+	merged := s.ranges[:0]
+	for _, r := range s.ranges {
+		if n := len(merged); n > 0 {
+			previous := &merged[n-1]
+			next := previous.last.Next()
+			if previous.last.BitLen() == r.first.BitLen() && (!next.IsValid() || !next.Less(r.first)) {
+				if previous.last.Less(r.last) {
+					previous.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	s.ranges = merged
+
+	return s, firstErr
+}
+
+func (s *IPSet) add(entries []string, groups map[string][]string, expanding map[string]bool, firstErr *error) {
+	fail := func(err error) {
+		if *firstErr == nil {
+			*firstErr = err
+		}
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if name, isGroup := strings.CutPrefix(entry, "@"); isGroup {
+			// viper lowercases every key in interchange.toml so group names are matched without case
+			name = strings.ToLower(name)
+			members, exists := groups[name]
+			if !exists {
+				fail(fmt.Errorf("unknown IP group '%s'", name))
+				continue
+			}
+			if expanding[name] {
+				fail(fmt.Errorf("IP group '%s' includes itself", name))
+				continue
+			}
+
+			expanding[name] = true
+			s.add(members, groups, expanding, firstErr)
+			delete(expanding, name)
+			continue
+		}
+
+		if entry == "all" {
+			s.ranges = append(s.ranges,
+				ipRange{netip.IPv4Unspecified(), lastAddr(netip.MustParsePrefix("0.0.0.0/0"))},
+				ipRange{netip.IPv6Unspecified(), lastAddr(netip.MustParsePrefix("::/0"))})
+			continue
+		}
+
+		r, err := parseIPRange(entry)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		s.ranges = append(s.ranges, r)
+	}
+}
+
+// reports whether the set contains an address
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+
+	// find the last range starting at or before addr
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return addr.Less(s.ranges[i].first)
+	}) - 1
+	if i < 0 {
+		return false
+	}
+	r := s.ranges[i]
+	return r.first.BitLen() == addr.BitLen() && !r.last.Less(addr)
+}
+
+// reports whether the set has no addresses in it
+func (s *IPSet) Empty() bool {
+	return s == nil || len(s.ranges) == 0
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseIPSetMergesRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+	}{
+		{"overlapping prefixes", []string{"10.0.0.0/24", "10.0.0.128/25"}, []string{"10.0.0.0-10.0.0.255"}},
+		{"adjacent prefixes", []string{"10.0.0.128/25", "10.0.0.0/25"}, []string{"10.0.0.0-10.0.0.255"}},
+		{"adjacent addresses", []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"}, []string{"10.0.0.1-10.0.0.3"}},
+		{"gap between addresses", []string{"10.0.0.1", "10.0.0.3"}, []string{"10.0.0.1-10.0.0.1", "10.0.0.3-10.0.0.3"}},
+		{"address inside a prefix", []string{"10.1.2.3", "10.0.0.0/8"}, []string{"10.0.0.0-10.255.255.255"}},
+		{"duplicates", []string{"10.0.0.1", " 10.0.0.1 "}, []string{"10.0.0.1-10.0.0.1"}},
+		{"last IPv4 address", []string{"255.255.255.255", "255.255.255.255"}, []string{"255.255.255.255-255.255.255.255"}},
+		{"host bits are masked", []string{"192.0.2.77/24"}, []string{"192.0.2.0-192.0.2.255"}},
+		{"IPv4 and IPv6 are kept apart", []string{"::/0", "0.0.0.0/0"}, []string{"0.0.0.0-255.255.255.255", "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}},
+		{"IPv4-mapped address", []string{"::ffff:10.0.0.1"}, []string{"10.0.0.1-10.0.0.1"}},
+		{"IPv4-mapped prefix merges with IPv4", []string{"::ffff:10.0.0.0/104", "11.0.0.0/8"}, []string{"10.0.0.0-11.255.255.255"}},
+		{"all", []string{"all", "10.0.0.1", "2001:db8::1"}, []string{"0.0.0.0-255.255.255.255", "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseIPSet(tt.entries, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, r := range s.ranges {
+				got = append(got, r.first.String()+"-"+r.last.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ranges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPSetContains(t *testing.T) {
+	tests := []struct {
+		entries []string
+		addr    string
+		want    bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "11.0.0.0", false},
+		{[]string{"10.0.0.0/8"}, "9.255.255.255", false},
+		{[]string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{[]string{"::ffff:10.0.0.0/104"}, "10.1.2.3", true},
+		{[]string{"0.0.0.0/0"}, "203.0.113.9", true},
+		{[]string{"0.0.0.0/0"}, "2001:db8::1", false},
+		{[]string{"::/0"}, "2001:db8::1", true},
+		{[]string{"::/0"}, "192.0.2.1", false},
+		{[]string{"::/0"}, "::ffff:192.0.2.1", false},
+		{[]string{"all"}, "192.0.2.1", true},
+		{[]string{"all"}, "2001:db8::1", true},
+		{[]string{"fe80::1"}, "fe80::1%eth0", true},
+		{[]string{"2001:db8::/32"}, "2001:db9::", false},
+		{[]string{}, "192.0.2.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.entries, ",")+"/"+tt.addr, func(t *testing.T) {
+			s, err := ParseIPSet(tt.entries, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	var s *IPSet
+	if s.Contains(netip.MustParseAddr("192.0.2.1")) || !s.Empty() {
+		t.Error("a nil set should be empty")
+	}
+}
+
+func TestParseIPSetGroups(t *testing.T) {
+	groups := map[string][]string{
+		"office":  {"192.0.2.0/24", "@vpn"},
+		"vpn":     {"198.51.100.7"},
+		"loop":    {"@loop"},
+		"ping":    {"@pong", "203.0.113.1"},
+		"pong":    {"@ping", "203.0.113.2"},
+		"invalid": {"203.0.113.300", "203.0.113.3"},
+	}
+
+	tests := []struct {
+		name     string
+		entries  []string
+		wantErr  string
+		contains []string
+		excludes []string
+	}{
+		{"nested groups", []string{"@office"}, "", []string{"192.0.2.5", "198.51.100.7"}, []string{"198.51.100.8"}},
+		{"names ignore case", []string{"@OFFICE"}, "", []string{"192.0.2.5", "198.51.100.7"}, nil},
+		{"same group twice", []string{"@vpn", "@office"}, "", []string{"198.51.100.7"}, nil},
+		{"unknown group", []string{"@missing", "10.0.0.1"}, "unknown IP group 'missing'", []string{"10.0.0.1"}, nil},
+		{"group including itself", []string{"@loop", "10.0.0.1"}, "IP group 'loop' includes itself", []string{"10.0.0.1"}, nil},
+		{"groups including each other", []string{"@ping"}, "IP group 'ping' includes itself", []string{"203.0.113.1", "203.0.113.2"}, nil},
+		{"invalid entry in a group", []string{"@invalid"}, "invalid IP address '203.0.113.300'", []string{"203.0.113.3"}, nil},
+		{"first error is returned", []string{"10.0.0.0/33", "bogus", "10.0.0.1"}, "invalid CIDR prefix '10.0.0.0/33'", []string{"10.0.0.1"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseIPSet(tt.entries, groups)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+
+			for _, addr := range tt.contains {
+				if !s.Contains(netip.MustParseAddr(addr)) {
+					t.Errorf("set doesn't contain %s", addr)
+				}
+			}
+			for _, addr := range tt.excludes {
+				if s.Contains(netip.MustParseAddr(addr)) {
+					t.Errorf("set contains %s", addr)
+				}
+			}
+		})
+	}
+}
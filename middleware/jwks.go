@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the most often a JWKS URL is fetched again because a token named a key that isn't in the set
+const jwksMinRefreshInterval = time.Minute
+
+// how long to wait before trying again after fetching a JWKS URL fails
+const jwksRetryInterval = 10 * time.Second
+
+// a key from a JSON Web Key Set. Key is an *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte for HMAC
+// secrets
+type jwk struct {
+	id  string
+	alg string
+	key any
+}
+
+// the keys in a JSON Web Key Set
+type jwkSet struct {
+	keys []jwk
+}
+
+// the fields of a JSON Web Key that interchange uses
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parses a JSON Web Key Set. Keys meant for encryption and keys of unsupported types are skipped, but a set without any
+// usable keys is an error
+func parseJWKS(data []byte) (*jwkSet, error) {
+	var raw struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %s", err)
+	}
+
+	set := &jwkSet{}
+	for i, k := range raw.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d in JWKS: %s", i, err)
+		}
+		if key != nil {
+			set.keys = append(set.keys, jwk{id: k.Kid, alg: k.Alg, key: key})
+		}
+	}
+	if len(set.keys) == 0 {
+		return nil, errors.New("JWKS has no signing keys")
+	}
+	return set, nil
+}
+
+func decodeKeyParam(value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("has an invalid key parameter")
+	}
+	return b, nil
+}
+
+// returns the key described by a JWK, or nil if it is of a type interchange doesn't support
+func (k rawJWK) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeKeyParam(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyParam(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("has an invalid RSA exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeKeyParam(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyParam(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) > 32 || len(y) > 32 {
+			return nil, errors.New("is not a valid P-256 key")
+		}
+		// an uncompressed point, which ParseUncompressedPublicKey checks is on the curve
+		point := append([]byte{4}, append(make([]byte, 32-len(x)), x...)...)
+		point = append(point, append(make([]byte, 32-len(y)), y...)...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, errors.New("is not a valid P-256 key")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := decodeKeyParam(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("is not a valid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return decodeKeyParam(k.K)
+	}
+	return nil, nil
+}
+
+// returned when there are no keys to check tokens against, which is the fault of the key source rather than the client
+var errNoKeys = errors.New("no keys are available to verify tokens")
+
+// where the keys used to verify tokens come from
+type keySource interface {
+	// returns the current keys. refresh asks for the keys to be fetched again if possible, because a token named a
+	// key that wasn't found
+	keys(ctx context.Context, refresh bool) (*jwkSet, error)
+}
+
+// keys from a local JWKS file, reloaded whenever it changes
+type fileKeySource struct {
+	file *credentialFile[jwkSet]
+}
+
+func (s *fileKeySource) keys(ctx context.Context, refresh bool) (*jwkSet, error) {
+	return s.file.get(), nil
+}
+
+// keys fetched from a JWKS URL and cached for a while. Only one fetch runs at a time and requests keep using the old
+// keys while it does. If fetching new keys fails, the old ones are used until a fetch succeeds
+type urlKeySource struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu        sync.Mutex
+	set       *jwkSet
+	fetched   time.Time
+	attempted time.Time
+	// closed once the fetch in progress finishes, nil if there isn't one
+	fetching chan struct{}
+}
+
+// creates a key source for a JWKS URL and starts fetching its keys so they are ready for the first request
+func newURLKeySource(ctx context.Context, url string, ttl time.Duration) *urlKeySource {
+	s := &urlKeySource{url: url, ttl: ttl, client: &http.Client{Timeout: 10 * time.Second}}
+	s.mu.Lock()
+	s.startFetch(ctx, time.Now())
+	s.mu.Unlock()
+	return s
+}
+
+func (s *urlKeySource) keys(ctx context.Context, refresh bool) (*jwkSet, error) {
+	s.mu.Lock()
+	now := time.Now()
+	stale := s.set == nil || now.Sub(s.fetched) > s.ttl || (refresh && now.Sub(s.fetched) > jwksMinRefreshInterval)
+	// failed fetches aren't retried on every request
+	if stale && s.fetching == nil && now.Sub(s.attempted) > jwksRetryInterval {
+		s.startFetch(ctx, now)
+	}
+	set, fetching := s.set, s.fetching
+	s.mu.Unlock()
+
+	// only requests that can't be checked with the keys already fetched wait for new ones
+	if fetching != nil && (set == nil || refresh) {
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+		}
+		s.mu.Lock()
+		set = s.set
+		s.mu.Unlock()
+	}
+
+	if set == nil {
+		return nil, errNoKeys
+	}
+	return set, nil
+}
+
+// fetches the keys in the background. It must be called with s.mu held
+func (s *urlKeySource) startFetch(ctx context.Context, now time.Time) {
+	done := make(chan struct{})
+	s.attempted, s.fetching = now, done
+
+	go func() {
+		set, err := s.fetch(ctx)
+
+		s.mu.Lock()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to fetch JWKS from '%s'", s.url), "err", err)
+		} else {
+			s.set, s.fetched = set, time.Now()
+		}
+		s.fetching = nil
+		s.mu.Unlock()
+		close(done)
+	}()
+}
+
+func (s *urlKeySource) fetch(ctx context.Context) (*jwkSet, error) {
+	// the fetch isn't tied to the request that needed the keys, which could be cancelled part way through
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
@@ -0,0 +1,360 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// the signing algorithms interchange can verify
+var jwtAlgorithms = []string{"HS256", "RS256", "ES256", "EdDSA"}
+
+// validates JSON Web Tokens sent as bearer tokens, checking their signature against a JSON Web Key Set along with
+// their issuer, audience, expiry and any claims the service requires. Chosen claims are sent to the upstream as headers
+type JWTValidator struct {
+	realm      string
+	keys       keySource
+	algorithms []string
+
+	issuer         string
+	audiences      []string
+	requiredClaims []string
+	requireExpiry  bool
+	leeway         time.Duration
+
+	// a cookie the token is read from when there is no Authorization header
+	cookie string
+	// the headers claims are sent to the upstream in, keyed by header
+	forwardClaims map[string]string
+}
+
+// creates a validator from a service's `jwt` table. A local JWKS file is watched for changes until ctx is cancelled
+func NewJWTValidator(ctx context.Context, cfg *config.Table, name string) (*JWTValidator, error) {
+	v := &JWTValidator{
+		realm:          cfg.String("realm", name),
+		algorithms:     cfg.StringSlice("algorithms"),
+		issuer:         cfg.String("issuer", ""),
+		audiences:      cfg.StringSlice("audience"),
+		requiredClaims: cfg.StringSlice("requiredClaims"),
+		requireExpiry:  cfg.Bool("requireExpiry", true),
+		leeway:         cfg.Duration("leeway", 30*time.Second),
+		cookie:         cfg.String("cookie", ""),
+		forwardClaims:  cfg.StringMap("forwardClaims"),
+	}
+	jwksFile := cfg.String("jwksFile", "")
+	jwksURL := cfg.String("jwksURL", "")
+	cacheTTL := cfg.Duration("jwksCacheTTL", time.Hour)
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if v.algorithms == nil {
+		v.algorithms = jwtAlgorithms
+	}
+	for _, alg := range v.algorithms {
+		if !slices.Contains(jwtAlgorithms, alg) {
+			return nil, fmt.Errorf("unsupported jwt algorithm '%s'", alg)
+		}
+	}
+	if v.leeway < 0 || cacheTTL <= 0 {
+		return nil, fmt.Errorf("jwt leeway must not be negative and jwksCacheTTL must be positive")
+	}
+	if strings.ContainsAny(v.realm, "\"\\") {
+		return nil, fmt.Errorf("jwt realm must not contain quotes or backslashes")
+	}
+
+	switch {
+	case jwksFile != "" && jwksURL != "":
+		return nil, fmt.Errorf("only one of jwt jwksFile and jwksURL can be set")
+	case jwksFile != "":
+		file, err := loadCredentialFile(ctx, jwksFile, parseJWKS)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = &fileKeySource{file: file}
+	case jwksURL != "":
+		v.keys = newURLKeySource(ctx, jwksURL, cacheTTL)
+	default:
+		return nil, fmt.Errorf("jwt jwksFile or jwksURL must be set")
+	}
+
+	return v, nil
+}
+
+// the parts of a token's header that interchange uses
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// returns the token sent with a request, if any
+func (v *JWTValidator) token(r *http.Request) string {
+	if token, found := bearerToken(r); found {
+		return token
+	}
+	if v.cookie != "" {
+		if cookie, err := r.Cookie(v.cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// checks a token's signature and claims, returning its claims if it is valid
+func (v *JWTValidator) validate(ctx context.Context, token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is malformed")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(v.algorithms, header.Alg) {
+		return nil, fmt.Errorf("token algorithm '%s' is not allowed", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("token signature is malformed")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := v.verifySignature(ctx, header, signed, signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// decodes a base64url encoded JSON part of a token, keeping numbers exact
+func decodeJWTPart(part string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("token is malformed")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		return errors.New("token is malformed")
+	}
+	return nil
+}
+
+// checks the signature against the key the token names, or every suitable key if it doesn't name one. The keys are
+// fetched again if the named key isn't found, in case the issuer has rotated its keys
+func (v *JWTValidator) verifySignature(ctx context.Context, header jwtHeader, signed, signature []byte) error {
+	for _, refresh := range []bool{false, true} {
+		set, err := v.keys.keys(ctx, refresh)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, key := range set.keys {
+			if (header.Kid != "" && key.id != header.Kid) || (key.alg != "" && key.alg != header.Alg) {
+				continue
+			}
+			found = true
+			if verifyJWTSignature(header.Alg, key.key, signed, signature) {
+				return nil
+			}
+		}
+		if found || header.Kid == "" {
+			break
+		}
+	}
+	return errors.New("token signature is invalid")
+}
+
+// checks a signature made with the given algorithm. The key must be of the type the algorithm uses, so a token can't
+// pass off a public key as an HMAC secret
+func verifyJWTSignature(alg string, key any, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, signature)
+	}
+	return false
+}
+
+// the furthest from 1970 in seconds a NumericDate claim is taken to be, which is around 35,000 years
+const maxNumericDate = 1 << 40
+
+// reads a NumericDate claim
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	value, exists := claims[name]
+	if !exists {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("token claim '%s' must be a number", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil || math.IsNaN(seconds) {
+		return time.Time{}, false, fmt.Errorf("token claim '%s' must be a number", name)
+	}
+	// clamped so dates far in the past or future don't overflow
+	seconds = math.Max(-maxNumericDate, math.Min(seconds, maxNumericDate))
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]any, now time.Time) error {
+	expiry, hasExpiry, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !hasExpiry && v.requireExpiry {
+		return errors.New("token has no expiry")
+	}
+	if hasExpiry && !now.Before(expiry.Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+
+	notBefore, hasNotBefore, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if hasNotBefore && now.Add(v.leeway).Before(notBefore) {
+		return errors.New("token is not valid yet")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return errors.New("token issuer is not accepted")
+	}
+
+	if len(v.audiences) > 0 {
+		var audiences []any
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []any{aud}
+		case []any:
+			audiences = aud
+		}
+		if !slices.ContainsFunc(audiences, func(aud any) bool {
+			s, ok := aud.(string)
+			return ok && slices.Contains(v.audiences, s)
+		}) {
+			return errors.New("token audience is not accepted")
+		}
+	}
+
+	for _, claim := range v.requiredClaims {
+		if _, exists := claims[claim]; !exists {
+			return fmt.Errorf("token is missing the '%s' claim", claim)
+		}
+	}
+	return nil
+}
+
+// formats a claim as a header value. Lists of strings are joined with commas and other structures are sent as JSON
+func claimHeaderValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		strs := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				data, _ := json.Marshal(v)
+				return string(data)
+			}
+			strs = append(strs, s)
+		}
+		return strings.Join(strs, ",")
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// returns middleware that turns away requests without a valid token with a 401
+func (v *JWTValidator) Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// the claim headers are only ever set by interchange so clients can't make up their own claims
+		for header := range v.forwardClaims {
+			r.Header.Del(header)
+		}
+
+		token := v.token(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, v.realm))
+			templates.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		claims, err := v.validate(r.Context(), token, time.Now())
+		if errors.Is(err, errNoKeys) {
+			templates.WriteError(w, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		if err != nil {
+			// the description can include parts of the token, which mustn't be able to break out of the quotes
+			description := strings.NewReplacer(`"`, "'", `\`, "").Replace(err.Error())
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token", error_description="%s"`, v.realm, description))
+			templates.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		for header, claim := range v.forwardClaims {
+			if value, exists := claims[claim]; exists && value != nil {
+				r.Header.Set(header, claimHeaderValue(value))
+			}
+		}
+
+		next.ServeHTTP(w, markAuthenticated(r))
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,322 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testHMACSecret       = []byte("a secret that is long enough for HS256")
+	testEdPublic, testEd = mustEd25519Key()
+)
+
+func mustEd25519Key() (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	return public, private
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// a JWKS holding the HMAC secret as "hmac" and the Ed25519 public key as "ed"
+func testJWKS() string {
+	return fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": "%s"},
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": "%s"}
+	]}`, b64(testHMACSecret), b64(testEdPublic))
+}
+
+func signHS256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func signEdDSA(signed []byte) []byte {
+	return ed25519.Sign(testEd, signed)
+}
+
+// builds a token from its header and claims, signed by sign
+func makeJWT(header, claims map[string]any, sign func([]byte) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	return signed + "." + b64(sign([]byte(signed)))
+}
+
+// writes testJWKS to a file, returning its path
+func testJWKSFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, []byte(testJWKS()), 0o600)
+	return path
+}
+
+func TestJWTValidate(t *testing.T) {
+	now := time.Now()
+	validator := newTestMiddleware(t, forService(t, NewJWTValidator), map[string]any{
+		"jwksfile":   testJWKSFile(t),
+		"algorithms": []any{"HS256", "EdDSA"},
+		"issuer":     "https://auth.example.com",
+		"audience":   []any{"api", "admin"},
+		"leeway":     "30s",
+	})
+
+	valid := func(extra map[string]any) map[string]any {
+		claims := map[string]any{
+			"iss": "https://auth.example.com",
+			"aud": "api",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for key, value := range extra {
+			if value == nil {
+				delete(claims, key)
+			} else {
+				claims[key] = value
+			}
+		}
+		return claims
+	}
+	hs256 := map[string]any{"alg": "HS256", "kid": "hmac"}
+	// the claims of one token with the signature of another
+	signed := strings.Split(makeJWT(hs256, valid(nil), signHS256(testHMACSecret)), ".")
+	changed := strings.Split(makeJWT(hs256, valid(map[string]any{"aud": "admin"}), signHS256(testHMACSecret)), ".")
+	forged := signed[0] + "." + changed[1] + "." + signed[2]
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"HS256", makeJWT(hs256, valid(nil), signHS256(testHMACSecret)), true},
+		{"EdDSA", makeJWT(map[string]any{"alg": "EdDSA", "kid": "ed"}, valid(nil), signEdDSA), true},
+		{"no kid tries every key", makeJWT(map[string]any{"alg": "EdDSA"}, valid(nil), signEdDSA), true},
+		{"wrong secret", makeJWT(hs256, valid(nil), signHS256([]byte("guess"))), false},
+		{"claims changed after signing", forged, false},
+		{"alg none", makeJWT(map[string]any{"alg": "none"}, valid(nil), func([]byte) []byte { return nil }), false},
+		{"alg that isn't allowed", makeJWT(map[string]any{"alg": "RS256", "kid": "hmac"}, valid(nil), signHS256(testHMACSecret)), false},
+		{"alg that doesn't match the key", makeJWT(map[string]any{"alg": "EdDSA", "kid": "hmac"}, valid(nil), signEdDSA), false},
+		{"public key used as an HMAC secret", makeJWT(map[string]any{"alg": "HS256", "kid": "ed"}, valid(nil), signHS256(testEdPublic)), false},
+		{"unknown kid", makeJWT(map[string]any{"alg": "HS256", "kid": "other"}, valid(nil), signHS256(testHMACSecret)), false},
+		{"expired", makeJWT(hs256, valid(map[string]any{"exp": now.Add(-time.Minute).Unix()}), signHS256(testHMACSecret)), false},
+		{"expired within the leeway", makeJWT(hs256, valid(map[string]any{"exp": now.Add(-10 * time.Second).Unix()}), signHS256(testHMACSecret)), true},
+		{"no expiry", makeJWT(hs256, valid(map[string]any{"exp": nil}), signHS256(testHMACSecret)), false},
+		{"expiry that isn't a number", makeJWT(hs256, valid(map[string]any{"exp": "tomorrow"}), signHS256(testHMACSecret)), false},
+		{"not valid yet", makeJWT(hs256, valid(map[string]any{"nbf": now.Add(time.Minute).Unix()}), signHS256(testHMACSecret)), false},
+		{"not valid yet within the leeway", makeJWT(hs256, valid(map[string]any{"nbf": now.Add(10 * time.Second).Unix()}), signHS256(testHMACSecret)), true},
+		{"audience in a list", makeJWT(hs256, valid(map[string]any{"aud": []any{"other", "admin"}}), signHS256(testHMACSecret)), true},
+		{"wrong audience", makeJWT(hs256, valid(map[string]any{"aud": "other"}), signHS256(testHMACSecret)), false},
+		{"no audience", makeJWT(hs256, valid(map[string]any{"aud": nil}), signHS256(testHMACSecret)), false},
+		{"wrong issuer", makeJWT(hs256, valid(map[string]any{"iss": "https://evil.example.com"}), signHS256(testHMACSecret)), false},
+		{"malformed", "not.a.token", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validator.validate(context.Background(), tt.token, now)
+			if (err == nil) != tt.valid {
+				t.Errorf("error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestJWTValidatorMiddleware(t *testing.T) {
+	token := makeJWT(map[string]any{"alg": "HS256", "kid": "hmac"}, map[string]any{
+		"sub":   "alice",
+		"roles": []any{"admin", "user"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}, signHS256(testHMACSecret))
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"bearer token", http.Header{"Authorization": {"Bearer " + token}}, http.StatusOK},
+		{"bearer scheme is case-insensitive", http.Header{"Authorization": {"BEARER " + token}}, http.StatusOK},
+		{"cookie", http.Header{"Cookie": {"session=" + token}}, http.StatusOK},
+		{"no token", http.Header{}, http.StatusUnauthorized},
+		{"made up claims without a token", http.Header{"X-User-Id": {"admin"}}, http.StatusUnauthorized},
+		{"invalid token", http.Header{"Authorization": {"Bearer " + token + "x"}}, http.StatusUnauthorized},
+	}
+
+	validator := newTestMiddleware(t, forService(t, NewJWTValidator), map[string]any{
+		"jwksfile":      testJWKSFile(t),
+		"cookie":        "session",
+		"forwardclaims": map[string]any{"X-User-ID": "sub", "X-Roles": "roles"},
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream *http.Request
+			handler := validator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if upstream.Header.Get("X-User-ID") != "alice" || upstream.Header.Get("X-Roles") != "admin,user" {
+				t.Errorf("claim headers = %v", upstream.Header)
+			}
+			if !Authenticated(upstream) {
+				t.Error("request wasn't marked as authenticated")
+			}
+		})
+	}
+}
+
+// serves testJWKS, counting the fetches and holding each one until release is closed
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+	status  atomic.Int32
+
+	mu      sync.Mutex
+	release chan struct{}
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{release: make(chan struct{})}
+	close(s.release)
+	s.status.Store(http.StatusOK)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		release := s.release
+		s.mu.Unlock()
+		<-release
+
+		w.WriteHeader(int(s.status.Load()))
+		w.Write([]byte(testJWKS()))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// makes fetches wait until the returned function is called
+func (s *jwksServer) hold() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release = make(chan struct{})
+	return sync.OnceFunc(func() { close(s.release) })
+}
+
+func TestURLKeySourceFetchesOnceAtStartup(t *testing.T) {
+	server := newJWKSServer(t)
+	release := server.hold()
+	source := newURLKeySource(t.Context(), server.URL, time.Hour)
+
+	// every request waits on the fetch started when the source was created rather than starting its own
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if _, err := source.keys(context.Background(), false); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	time.Sleep(20 * time.Millisecond)
+	release()
+	wg.Wait()
+
+	if n := server.fetches.Load(); n != 1 {
+		t.Errorf("JWKS was fetched %d times, want 1", n)
+	}
+}
+
+func TestURLKeySourceServesOldKeysWhileFetching(t *testing.T) {
+	tests := []struct {
+		name    string
+		refresh bool
+		status  int
+		// whether the request waits for the fetch to finish
+		wantWait bool
+	}{
+		{"expired keys are used while fetching", false, http.StatusOK, false},
+		{"unknown key waits for the fetch", true, http.StatusOK, true},
+		{"failed fetch keeps the old keys", true, http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newJWKSServer(t)
+			source := newURLKeySource(t.Context(), server.URL, time.Hour)
+			old, err := source.keys(context.Background(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the keys are old enough to be fetched again for either reason
+			source.mu.Lock()
+			source.fetched = time.Now().Add(-2 * time.Hour)
+			source.attempted = source.fetched
+			source.mu.Unlock()
+			server.status.Store(int32(tt.status))
+			release := server.hold()
+			defer release()
+
+			result := make(chan *jwkSet, 1)
+			go func() {
+				set, err := source.keys(context.Background(), tt.refresh)
+				if err != nil {
+					t.Error(err)
+				}
+				result <- set
+			}()
+
+			select {
+			case set := <-result:
+				if tt.wantWait {
+					t.Fatal("request didn't wait for the fetch")
+				}
+				if set != old {
+					t.Error("request didn't get the old keys")
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+				if !tt.wantWait {
+					t.Fatal("request waited for the fetch")
+				}
+			}
+
+			release()
+			set := <-result
+			if tt.status == http.StatusOK && set == old {
+				t.Error("request didn't get the new keys")
+			}
+			if tt.status != http.StatusOK && set != old {
+				t.Error("request didn't get the old keys after the fetch failed")
+			}
+			if n := server.fetches.Load(); n != 2 {
+				t.Errorf("JWKS was fetched %d times, want 2", n)
+			}
+		})
+	}
+}
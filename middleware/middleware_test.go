@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+)
+
+// builds middleware from its configuration, failing the test if the configuration is rejected
+func newTestMiddleware[T any](t *testing.T, build func(*config.Table) (T, error), cfg map[string]any) T {
+	t.Helper()
+	m, err := build(config.NewTable(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// adapts the constructor of middleware that also takes a context and the name of its service to newTestMiddleware
+func forService[T any](t *testing.T, build func(context.Context, *config.Table, string) (T, error)) func(*config.Table) (T, error) {
+	return func(cfg *config.Table) (T, error) {
+		return build(t.Context(), cfg, "test")
+	}
+}
+
+// returns a request sent directly from addr
+func requestFrom(addr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = addr + ":1234"
+	return r
+}
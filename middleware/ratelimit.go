@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/templates"
+)
+
+// how often buckets that have refilled completely are dropped so clients that went away don't use up memory
+const bucketSweepInterval = time.Minute
+
+// a token bucket for a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limits the rate of requests with a token bucket per client. Clients are identified by their IP, a header such as an
+// API key or the route they are requesting
+type RateLimiter struct {
+	// tokens added per second
+	rate float64
+	// the most tokens a bucket can hold, which is how many requests can be made at once
+	burst float64
+
+	key    string
+	header string
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// creates a rate limiter from a `rateLimit` table. `requests` requests are allowed every `per`, with up to `burst`
+// made at once
+func NewRateLimiter(cfg *config.Table) (*RateLimiter, error) {
+	requests := cfg.Float("requests", 0)
+	per := cfg.Duration("per", time.Second)
+	burst := cfg.Float("burst", requests)
+	l := &RateLimiter{
+		key:       cfg.String("key", "ip"),
+		header:    cfg.String("header", ""),
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	if requests <= 0 || per <= 0 {
+		return nil, fmt.Errorf("rateLimit requests and per must be positive")
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("rateLimit burst must be at least 1")
+	}
+	switch l.key {
+	case "ip", "route":
+	case "header":
+		if l.header == "" {
+			return nil, fmt.Errorf("rateLimit header must be set when key is 'header'")
+		}
+	default:
+		return nil, fmt.Errorf("invalid rateLimit key '%s'", l.key)
+	}
+
+	l.rate = requests / per.Seconds()
+	l.burst = burst
+	return l, nil
+}
+
+// carries over the buckets of a limiter built from an earlier configuration so a reload doesn't refill every
+// client's bucket. Nothing is carried over if clients are identified differently
+func (l *RateLimiter) Inherit(previous *RateLimiter) {
+	if previous.key != l.key || previous.header != l.header {
+		return
+	}
+
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range previous.buckets {
+		l.buckets[key] = &bucket{tokens: math.Min(l.burst, b.tokens), last: b.last}
+	}
+	l.lastSweep = previous.lastSweep
+}
+
+// returns the bucket a request is counted against. Requests keyed by header that don't have it are counted against
+// their IP instead
+func (l *RateLimiter) bucketKey(r *http.Request, route string) string {
+	switch l.key {
+	case "route":
+		return "route " + route
+	case "header":
+		if value := r.Header.Get(l.header); value != "" {
+			return "header " + value
+		}
+	}
+	return "ip " + ClientIP(r).String()
+}
+
+// takes a token from the bucket if there is one. It returns whether the request is allowed, the tokens left and how
+// long until the next token is added
+func (l *RateLimiter) take(key string, now time.Time) (bool, float64, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > bucketSweepInterval {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, b.tokens, wait
+	}
+	b.tokens--
+	return true, b.tokens, 0
+}
+
+// drops the buckets that would have refilled by now. It must be called with l.mu held
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rounds a duration up to whole seconds for use in headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// returns middleware that limits the requests to the given route
+func (l *RateLimiter) Middleware(route string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			allowed, remaining, wait := l.take(l.bucketKey(r, route), time.Now())
+
+			// time until the bucket is full again
+			reset := time.Duration((l.burst - remaining) / l.rate * float64(time.Second))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(int(l.burst)))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(wait))))
+				templates.WriteError(w, http.StatusTooManyRequests, "Too Many Requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grqphical/interchange/config"
+)
+
+func TestNewRateLimiterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+	}{
+		{"no requests", map[string]any{}},
+		{"negative per", map[string]any{"requests": 10, "per": "-1s"}},
+		{"burst under one", map[string]any{"requests": 10, "burst": 0.5}},
+		{"header key without a header", map[string]any{"requests": 10, "key": "header"}},
+		{"unknown key", map[string]any{"requests": 10, "key": "user"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRateLimiter(config.NewTable(tt.cfg)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	limiter := newTestMiddleware(t, NewRateLimiter, map[string]any{"requests": 2, "per": "1s", "burst": 3})
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		after   time.Duration
+		allowed bool
+	}{
+		{"first of the burst", 0, true},
+		{"second of the burst", 0, true},
+		{"last of the burst", 0, true},
+		{"burst used up", 0, false},
+		{"half a token later", 250 * time.Millisecond, false},
+		{"a token later", 500 * time.Millisecond, true},
+		{"refilled", 10 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		allowed, _, wait := limiter.take("ip 192.0.2.1", start.Add(tt.after))
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, allowed, tt.allowed)
+		}
+		if !allowed && wait <= 0 {
+			t.Errorf("%s: limited request wasn't told how long to wait", tt.name)
+		}
+	}
+}
+
+func TestRateLimiterBucketKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    map[string]any
+		header string
+		want   string
+	}{
+		{"ip", map[string]any{"requests": 1}, "", "ip 192.0.2.1"},
+		{"route", map[string]any{"requests": 1, "key": "route"}, "", "route api"},
+		{"header", map[string]any{"requests": 1, "key": "header", "header": "X-API-Key"}, "secret", "header secret"},
+		{"missing header falls back to ip", map[string]any{"requests": 1, "key": "header", "header": "X-API-Key"}, "", "ip 192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newTestMiddleware(t, NewRateLimiter, tt.cfg)
+			r := requestFrom("192.0.2.1")
+			if tt.header != "" {
+				r.Header.Set("X-API-Key", tt.header)
+			}
+			if got := limiter.bucketKey(r, "api"); got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := newTestMiddleware(t, NewRateLimiter, map[string]any{"requests": 1, "per": "1m"})
+	handler := limiter.Middleware("api")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want 60", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimiterInherit(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     map[string]any
+		allowed bool
+	}{
+		{"same settings keep the bucket", map[string]any{"requests": 1, "per": "1m"}, false},
+		{"new rate keeps the bucket", map[string]any{"requests": 2, "per": "1h"}, false},
+		{"new key starts over", map[string]any{"requests": 1, "per": "1m", "key": "route"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			previous := newTestMiddleware(t, NewRateLimiter, map[string]any{"requests": 1, "per": "1m"})
+			previous.take("ip 192.0.2.1", now)
+			previous.take("route api", now)
+
+			limiter := newTestMiddleware(t, NewRateLimiter, tt.cfg)
+			limiter.Inherit(previous)
+			if allowed, _, _ := limiter.take(limiter.bucketKey(requestFrom("192.0.2.1"), "api"), now); allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
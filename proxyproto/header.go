@@ -0,0 +1,217 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// the signature every version 2 header starts with
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// the longest a version 1 header can be, including the CRLF
+const v1MaxLength = 107
+
+// the addresses of the original connection carried by a PROXY protocol header
+type Header struct {
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// reads a version 1 or 2 header from the start of a connection. A nil header is returned for headers that don't carry
+// an address, such as health checks sent by the load balancer itself, in which case the connection's own addresses
+// should be used
+func Read(r *bufio.Reader) (*Header, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, errors.New("connection did not start with a PROXY protocol header")
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+	}
+
+	text, found := strings.CutSuffix(string(line), "\r\n")
+	if !found {
+		return nil, errors.New("PROXY protocol v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header '%s'", text)
+	}
+
+	source, err := parseV1Address(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseV1Address(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Source: source, Destination: destination}, nil
+}
+
+func parseV1Address(host, port string, ipv4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil || addr.Is4() != ipv4 || addr.Zone() != "" {
+		return netip.AddrPort{}, fmt.Errorf("invalid address '%s' in PROXY protocol v1 header", host)
+	}
+	// ports are written without leading zeroes or signs
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || strconv.FormatUint(n, 10) != port {
+		return netip.AddrPort{}, fmt.Errorf("invalid port '%s' in PROXY protocol v1 header", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(n)), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if err := readFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+
+	// the addresses are followed by optional TLVs, which interchange doesn't use
+	payload := make([]byte, length)
+	if err := readFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL, sent by the proxy for its own connections such as health checks
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", versionCommand&0x0f)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 0x1:
+		size = 4
+	case 0x2:
+		size = 16
+	default:
+		// UNSPEC and unix sockets carry no address that can be used
+		return nil, nil
+	}
+	if len(payload) < size*2+4 {
+		return nil, errors.New("PROXY protocol v2 header is too short for its addresses")
+	}
+
+	source, _ := netip.AddrFromSlice(payload[:size])
+	destination, _ := netip.AddrFromSlice(payload[size : size*2])
+	ports := payload[size*2:]
+	return &Header{
+		Source:      netip.AddrPortFrom(source, binary.BigEndian.Uint16(ports[0:2])),
+		Destination: netip.AddrPortFrom(destination, binary.BigEndian.Uint16(ports[2:4])),
+	}, nil
+}
+
+func readFull(r *bufio.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	return nil
+}
+
+// encodes the header in the given protocol version. A nil header is encoded as one that carries no address, which
+// tells the receiver to use the connection's own addresses
+func (h *Header) Format(version int) []byte {
+	source, destination := h.addresses()
+
+	if version == 1 {
+		if !source.IsValid() {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if source.Addr().Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, source.Addr(), destination.Addr(), source.Port(), destination.Port())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(v2Signature)
+	if !source.IsValid() {
+		// LOCAL with an unspecified family
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// PROXY over TCP, on IPv4 or IPv6
+	family := byte(0x11)
+	if source.Addr().Is6() {
+		family = 0x21
+	}
+	source16, destination16 := source.Addr().AsSlice(), destination.Addr().AsSlice()
+	buf.Write([]byte{0x21, family})
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(source16)*2+4))
+	buf.Write(source16)
+	buf.Write(destination16)
+	_ = binary.Write(buf, binary.BigEndian, source.Port())
+	_ = binary.Write(buf, binary.BigEndian, destination.Port())
+	return buf.Bytes()
+}
+
+// returns the header's addresses in the same family, mapping IPv4 addresses into IPv6 if the two differ. Invalid
+// addresses are returned if there is no header or no source address
+func (h *Header) addresses() (netip.AddrPort, netip.AddrPort) {
+	if h == nil || !h.Source.IsValid() {
+		return netip.AddrPort{}, netip.AddrPort{}
+	}
+
+	source := netip.AddrPortFrom(h.Source.Addr().Unmap().WithZone(""), h.Source.Port())
+	destination := h.Destination
+	if !destination.IsValid() {
+		// the receiver only cares about the source, so an unknown destination is sent as the unspecified address
+		destination = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		if source.Addr().Is6() {
+			destination = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		}
+	}
+	destination = netip.AddrPortFrom(destination.Addr().Unmap().WithZone(""), destination.Port())
+
+	if source.Addr().Is4() != destination.Addr().Is4() {
+		source = netip.AddrPortFrom(netip.AddrFrom16(source.Addr().As16()), source.Port())
+		destination = netip.AddrPortFrom(netip.AddrFrom16(destination.Addr().As16()), destination.Port())
+	}
+	return source, destination
+}
@@ -0,0 +1,142 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// builds a version 2 header from its version and command, family and payload
+func v2Header(versionCommand, family byte, payload ...byte) string {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, versionCommand, family, byte(len(payload)>>8), byte(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestRead(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	ipv6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	ipv6 = append(ipv6, 0x30, 0x39, 0x01, 0xbb)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    *Header
+		wantErr bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n", &Header{
+			Source:      netip.MustParseAddrPort("192.0.2.1:12345"),
+			Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+		}, false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", &Header{
+			Source:      netip.MustParseAddrPort("[2001:db8::1]:12345"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		}, false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", nil, false},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 12345 443\r\n", nil, false},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n", nil, true},
+		{"v1 unknown family", "PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\n", nil, true},
+		{"v1 IPv6 address in TCP4", "PROXY TCP4 2001:db8::1 198.51.100.1 12345 443\r\n", nil, true},
+		{"v1 zoned address", "PROXY TCP6 fe80::1%eth0 2001:db8::2 12345 443\r\n", nil, true},
+		{"v1 port with a leading zero", "PROXY TCP4 192.0.2.1 198.51.100.1 012345 443\r\n", nil, true},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", nil, true},
+		{"v1 missing fields", "PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n", nil, true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n", nil, true},
+		{"v1 cut off", "PROXY TCP4 192.0.2.1", nil, true},
+		{"v2 IPv4", v2Header(0x21, 0x11, ipv4...), &Header{
+			Source:      netip.MustParseAddrPort("192.0.2.1:12345"),
+			Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+		}, false},
+		{"v2 IPv6", v2Header(0x21, 0x21, ipv6...), &Header{
+			Source:      netip.MustParseAddrPort("[2001:db8::1]:12345"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		}, false},
+		{"v2 with TLVs", v2Header(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)...), &Header{
+			Source:      netip.MustParseAddrPort("192.0.2.1:12345"),
+			Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+		}, false},
+		{"v2 LOCAL", v2Header(0x20, 0x00), nil, false},
+		{"v2 LOCAL with addresses", v2Header(0x20, 0x11, ipv4...), nil, false},
+		{"v2 UNSPEC", v2Header(0x21, 0x00), nil, false},
+		{"v2 unix socket", v2Header(0x21, 0x31, make([]byte, 216)...), nil, false},
+		{"v2 wrong version", v2Header(0x11, 0x11, ipv4...), nil, true},
+		{"v2 unknown command", v2Header(0x22, 0x11, ipv4...), nil, true},
+		{"v2 payload too short for its addresses", v2Header(0x21, 0x21, ipv4...), nil, true},
+		{"v2 cut off", v2Header(0x21, 0x11, ipv4...)[:20], nil, true},
+		{"no header", "GET / HTTP/1.1\r\n\r\n", nil, true},
+		{"too short for a signature", "PROXY", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "data"))
+
+			header, err := Read(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if (header == nil) != (tt.want == nil) || (header != nil && *header != *tt.want) {
+				t.Errorf("header = %+v, want %+v", header, tt.want)
+			}
+			// the connection's data starts right after the header
+			if rest, _ := io.ReadAll(r); string(rest) != "data" {
+				t.Errorf("data after the header = %q, want %q", rest, "data")
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		header *Header
+		want   *Header
+	}{
+		{"no header", nil, nil},
+		{"IPv4", &Header{
+			Source:      netip.MustParseAddrPort("192.0.2.1:12345"),
+			Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+		}, nil},
+		{"IPv6", &Header{
+			Source:      netip.MustParseAddrPort("[2001:db8::1]:12345"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		}, nil},
+		{"mixed families are sent as IPv6", &Header{
+			Source:      netip.MustParseAddrPort("192.0.2.1:12345"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		}, &Header{
+			Source:      netip.MustParseAddrPort("[::ffff:192.0.2.1]:12345"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+		}},
+		{"unknown destination", &Header{
+			Source: netip.MustParseAddrPort("192.0.2.1:12345"),
+		}, &Header{
+			Source:      netip.MustParseAddrPort("192.0.2.1:12345"),
+			Destination: netip.MustParseAddrPort("0.0.0.0:0"),
+		}},
+	}
+
+	for _, tt := range tests {
+		want := tt.want
+		if want == nil {
+			want = tt.header
+		}
+
+		for _, version := range []int{1, 2} {
+			header, err := Read(bufio.NewReader(strings.NewReader(string(tt.header.Format(version)))))
+			if err != nil {
+				t.Errorf("%s v%d: %s", tt.name, version, err)
+				continue
+			}
+			if (header == nil) != (want == nil) || (header != nil && *header != *want) {
+				t.Errorf("%s v%d: header = %+v, want %+v", tt.name, version, header, want)
+			}
+		}
+	}
+}
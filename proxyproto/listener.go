@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// wraps a listener so connections from trusted sources must start with a PROXY protocol header, whose addresses are
+// then reported as the connection's own. Connections from anywhere else are passed through untouched, so a client
+// can't claim to be someone else by sending a header itself
+type Listener struct {
+	net.Listener
+	// reports whether a connection from the address is from a proxy that sends PROXY protocol headers
+	Trusted func(netip.Addr) bool
+	// how long a trusted proxy has to send its header before the connection is closed
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.Trusted(addrOf(conn.RemoteAddr()).Addr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.HeaderTimeout}, nil
+}
+
+// a connection from a trusted proxy. The header is read the first time the connection is used rather than when it is
+// accepted so a slow proxy can't hold up other connections
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	c.header, c.err = Read(c.reader)
+	c.Conn.SetReadDeadline(time.Time{})
+
+	if c.err != nil {
+		slog.Warn(fmt.Sprintf("closing connection from %s: %s", c.Conn.RemoteAddr(), c.err))
+		c.Conn.Close()
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// returns the client's address from the header, or the proxy's address if the header didn't carry one
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.header.Source)
+}
+
+// returns the address the client connected to from the header, or the connection's own if the header didn't carry one
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header == nil {
+		return c.Conn.LocalAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.header.Destination)
+}
+
+// returns the address and port of a connection's address, or an invalid address if it isn't an IP address
+func addrOf(addr net.Addr) netip.AddrPort {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		addrPort := tcp.AddrPort()
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort
+}
@@ -0,0 +1,64 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    bool
+		send       string
+		wantRemote string
+		wantData   string
+	}{
+		{"trusted proxy", true, "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nhello", "192.0.2.1:12345", "hello"},
+		{"trusted proxy's own connection", true, "PROXY UNKNOWN\r\nhello", "", "hello"},
+		{"untrusted client's header is passed through", false, "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n", "", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"},
+		{"trusted proxy without a header", true, "hello", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := &Listener{
+				Listener:      ln,
+				Trusted:       func(netip.Addr) bool { return tt.trusted },
+				HeaderTimeout: time.Second,
+			}
+			defer listener.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.send))
+			client.(*net.TCPConn).CloseWrite()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			wantRemote := tt.wantRemote
+			if wantRemote == "" {
+				wantRemote = client.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantRemote {
+				t.Errorf("remote address = %s, want %s", got, wantRemote)
+			}
+			if data, _ := io.ReadAll(conn); string(data) != tt.wantData {
+				t.Errorf("data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/grqphical/interchange/handlers"
+	"github.com/grqphical/interchange/middleware"
+	"github.com/grqphical/interchange/templates"
+)
+
+// conditions beyond the route that a request must meet to be handled by a service. An empty expected value only
+// requires the header, query parameter or cookie to be present
+type requestMatcher struct {
+	methods        map[string]bool
+	headers        map[string]string
+	headerPatterns map[string]*regexp.Regexp
+	query          map[string]string
+	cookies        map[string]string
+}
+
+func buildRequestMatcher(cfg *config.Table) (*requestMatcher, error) {
+	m := &requestMatcher{
+		methods:        map[string]bool{},
+		headers:        cfg.StringMap("headers"),
+		headerPatterns: map[string]*regexp.Regexp{},
+		query:          cfg.StringMap("query"),
+		cookies:        cfg.StringMap("cookies"),
+	}
+	for _, method := range cfg.StringSlice("methods") {
+		m.methods[strings.ToUpper(method)] = true
+	}
+
+	for name, pattern := range cfg.StringMap("headerPatterns") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header pattern '%s': %s", pattern, err)
+		}
+		m.headerPatterns[name] = re
+	}
+
+	return m, cfg.Err()
+}
+
+// returns the number of conditions the matcher checks, used to rank more specific services first
+func (m *requestMatcher) conditions() int {
+	n := len(m.headers) + len(m.headerPatterns) + len(m.query) + len(m.cookies)
+	if len(m.methods) > 0 {
+		n++
+	}
+	return n
+}
+
+// reports whether the values contain the expected value, or any value if expected is empty
+func containsValue(values []string, expected string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if expected == "" {
+		return true
+	}
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *requestMatcher) matches(r *http.Request) bool {
+	if len(m.methods) > 0 && !m.methods[r.Method] {
+		return false
+	}
+
+	for name, expected := range m.headers {
+		if !containsValue(r.Header.Values(name), expected) {
+			return false
+		}
+	}
+
+	for name, pattern := range m.headerPatterns {
+		if !pattern.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+
+	// viper lowercases every key in interchange.toml so query and cookie names are compared without case
+	if len(m.query) > 0 {
+		query := r.URL.Query()
+		for name, expected := range m.query {
+			var values []string
+			for key, vs := range query {
+				if strings.EqualFold(key, name) {
+					values = append(values, vs...)
+				}
+			}
+			if !containsValue(values, expected) {
+				return false
+			}
+		}
+	}
+
+	if len(m.cookies) > 0 {
+		cookies := r.Cookies()
+		for name, expected := range m.cookies {
+			var values []string
+			for _, cookie := range cookies {
+				if strings.EqualFold(cookie.Name, name) {
+					values = append(values, cookie.Value)
+				}
+			}
+			if !containsValue(values, expected) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// a service registered on a route
+type serviceRoute struct {
+	name string
+	// the path prefix the service handles, always ending in a slash
+	prefix   string
+	priority int
+	match    *requestMatcher
+	handler  http.Handler
+}
+
+// normalizes the route set in a service's configuration into the path prefix it handles
+func routePrefix(route string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(route, "*"), "/") + "/"
+}
+
+// builds the route for a service from its `route`, `priority` and `match` settings. The handler is filled in once
+// the service itself has been built
+func buildServiceRoute(service map[string]any, name string) (*serviceRoute, error) {
+	cfg := config.NewTable(service)
+	route := &serviceRoute{
+		name:     name,
+		prefix:   routePrefix(cfg.String("route", "/")),
+		priority: cfg.Int("priority", 0),
+	}
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	match, err := buildRequestMatcher(cfg.Table("match"))
+	if err != nil {
+		return nil, err
+	}
+	route.match = match
+
+	return route, nil
+}
+
+// the services of a single host, ordered so the first one that matches a request is the one that should handle it
+type serviceTable struct {
+	routes []*serviceRoute
+}
+
+// adds a route to the table. Routes with a higher priority come first, then routes with a longer prefix, then
+// routes with more match conditions. Services that tie on all three are ordered by name
+func (t *serviceTable) add(route *serviceRoute) {
+	t.routes = append(t.routes, route)
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		a, b := t.routes[i], t.routes[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if len(a.prefix) != len(b.prefix) {
+			return len(a.prefix) > len(b.prefix)
+		}
+		if a.match.conditions() != b.match.conditions() {
+			return a.match.conditions() > b.match.conditions()
+		}
+		return a.name < b.name
+	})
+}
+
+// returns the route that should handle the request, or nil if there isn't one
+func (t *serviceTable) find(r *http.Request) *serviceRoute {
+	if t == nil {
+		return nil
+	}
+
+	for _, route := range t.routes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) && route.match.matches(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// wraps the handler of a service in the middleware configured for it
+func wrapServiceHandler(ctx context.Context, handler http.Handler, service map[string]any, name string, limiters *rateLimiters, debug *handlers.DebugHandler) (http.Handler, error) {
+	cfg := config.NewTable(service)
+	// registered with the debug handler once all the middleware has been built so a service that fails to load isn't
+	// shown
+	var providers []handlers.DebugInfoProvider
+
+	if cfg.Has("maxConcurrent") {
+		maxConcurrent := cfg.Int("maxConcurrent", 0)
+		if err := cfg.Err(); err != nil {
+			return nil, err
+		}
+		limiter, err := middleware.NewConcurrencyLimiter(maxConcurrent, cfg.Table("queue"))
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, limiter)
+		handler = limiter.Middleware(handler)
+	}
+
+	// checked after the local auth checks so requests they turn away aren't sent to the auth server
+	if cfg.Has("forwardAuth") {
+		forwardAuth, err := middleware.NewForwardAuth(cfg.Table("forwardAuth"))
+		if err != nil {
+			return nil, err
+		}
+		handler = forwardAuth.Middleware(handler)
+	}
+
+	// checked after the rate limits so they slow down clients guessing credentials
+	if cfg.Has("auth") {
+		auth, err := middleware.NewAuthenticator(ctx, cfg.Table("auth"), name)
+		if err != nil {
+			return nil, err
+		}
+		handler = auth.Middleware(handler)
+	}
+
+	if cfg.Has("jwt") {
+		validator, err := middleware.NewJWTValidator(ctx, cfg.Table("jwt"), name)
+		if err != nil {
+			return nil, err
+		}
+		handler = validator.Middleware(handler)
+	}
+
+	if cfg.Has("rateLimit") {
+		limiter, err := limiters.build(name, cfg.Table("rateLimit"))
+		if err != nil {
+			return nil, err
+		}
+		handler = limiter.Middleware(name)(handler)
+	}
+
+	// checked first so denied clients don't use up rate limits
+	if cfg.Has("access") {
+		access, err := middleware.NewAccessList(cfg.Table("access"))
+		if err != nil {
+			return nil, err
+		}
+		handler = access.Middleware(handler)
+	}
+
+	for _, provider := range providers {
+		debug.Register(name, provider)
+	}
+	return handler, nil
+}
+
+// a wildcard host such as `*.example.com` along with its services
+type wildcardHost struct {
+	// the part of the pattern after the `*`, such as `.example.com`
+	suffix string
+	table  *serviceTable
+}
+
+// routes requests to a separate table of services for each host so services on different hosts can share the same
+// route. Exact hosts are matched first, then wildcard hosts with the most specific one winning. Requests for any
+// other host are treated as if they were for defaultHost if it is set. If none of the host's services match, the
+// request goes to the fallback table which holds the services that don't set any hosts and so apply to all of them
+type hostRouter struct {
+	exact       map[string]*serviceTable
+	wildcards   []wildcardHost
+	fallback    *serviceTable
+	defaultHost string
+}
+
+func newHostRouter(defaultHost string) *hostRouter {
+	return &hostRouter{
+		exact:       map[string]*serviceTable{},
+		fallback:    &serviceTable{},
+		defaultHost: normalizeHost(defaultHost),
+	}
+}
+
+// lowercases a host and strips any port and trailing dot from it
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// returns the table for the given host pattern, creating it if it doesn't exist yet
+func (h *hostRouter) table(pattern string) *serviceTable {
+	pattern = normalizeHost(pattern)
+	if pattern == "" || pattern == "*" {
+		return h.fallback
+	}
+
+	if rest, isWildcard := strings.CutPrefix(pattern, "*."); isWildcard {
+		suffix := "." + rest
+		for _, wildcard := range h.wildcards {
+			if wildcard.suffix == suffix {
+				return wildcard.table
+			}
+		}
+
+		t := &serviceTable{}
+		h.wildcards = append(h.wildcards, wildcardHost{suffix, t})
+		sort.SliceStable(h.wildcards, func(i, j int) bool {
+			return len(h.wildcards[i].suffix) > len(h.wildcards[j].suffix)
+		})
+		return t
+	}
+
+	t, exists := h.exact[pattern]
+	if !exists {
+		t = &serviceTable{}
+		h.exact[pattern] = t
+	}
+	return t
+}
+
+// registers a service route on each of the given hosts, or on every host if none are given
+func (h *hostRouter) Handle(hosts []string, route *serviceRoute) {
+	if len(hosts) == 0 {
+		h.fallback.add(route)
+		return
+	}
+
+	for _, host := range hosts {
+		h.table(host).add(route)
+	}
+}
+
+// finds the table for a host, returning nil if only the fallback table applies
+func (h *hostRouter) match(host string) *serviceTable {
+	if t, exists := h.exact[host]; exists {
+		return t
+	}
+	for _, wildcard := range h.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) {
+			return wildcard.table
+		}
+	}
+	return nil
+}
+
+func (h *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+
+	table := h.match(normalizeHost(host))
+	if table == nil && h.defaultHost != "" {
+		table = h.match(h.defaultHost)
+	}
+
+	route := table.find(r)
+	if route == nil {
+		route = h.fallback.find(r)
+	}
+	if route == nil {
+		templates.WriteError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	route.handler.ServeHTTP(w, r)
+}
+
+// reads the optional list of hosts a service is served on. A wildcard can only stand for whole labels at the start
+// of a host, otherwise `*example.com` would also match `badexample.com`
+func serviceHosts(service map[string]any) ([]string, error) {
+	cfg := config.NewTable(service)
+	hosts := cfg.StringSlice("hosts")
+	if err := cfg.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, host := range hosts {
+		pattern := normalizeHost(host)
+		suffix, isWildcard := strings.CutPrefix(pattern, "*.")
+		if pattern != "*" && (strings.Contains(suffix, "*") || (isWildcard && suffix == "")) {
+			return nil, fmt.Errorf("invalid host '%s', wildcards must be written as '*.example.com'", host)
+		}
+	}
+	return hosts, nil
+}
+
+// the rate limiters built while loading the configuration, keyed by the service they belong to or "" for the global
+// limit. Each inherits the buckets of the limiter it replaces so reloading doesn't reset them
+type rateLimiters struct {
+	previous map[string]*middleware.RateLimiter
+	built    map[string]*middleware.RateLimiter
+}
+
+func newRateLimiters(previous *rateLimiters) *rateLimiters {
+	l := &rateLimiters{built: map[string]*middleware.RateLimiter{}}
+	if previous != nil {
+		l.previous = previous.built
+	}
+	return l
+}
+
+// builds the rate limiter for a service, or the global limit if name is empty
+func (l *rateLimiters) build(name string, cfg *config.Table) (*middleware.RateLimiter, error) {
+	limiter, err := middleware.NewRateLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if previous, exists := l.previous[name]; exists {
+		limiter.Inherit(previous)
+	}
+	l.built[name] = limiter
+	return limiter, nil
+}
+
+// a router built from the configuration along with the function that stops its background work
+type builtRouter struct {
+	handler http.Handler
+	cancel  context.CancelFunc
+}
+
+// serves requests using the most recently built router so the configuration can be reloaded without restarting
+// the server
+type reloadableRouter struct {
+	logger *ApplicationLogHandler
+
+	mu       sync.Mutex
+	current  atomic.Pointer[builtRouter]
+	limiters *rateLimiters
+}
+
+// builds a new router from the current configuration and starts sending requests to it. The background work of the
+// previous router, such as health checks, is stopped but requests it is already handling are left to finish. If the
+// configuration can't be loaded the previous router is kept
+func (rr *reloadableRouter) reload(ctx context.Context) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	limiters := newRateLimiters(rr.limiters)
+	handler, err := buildHTTPRouter(ctx, rr.logger, limiters)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	rr.limiters = limiters
+	old := rr.current.Swap(&builtRouter{
+		handler: handler,
+		cancel:  cancel,
+	})
+	if old != nil {
+		old.cancel()
+	}
+	return nil
+}
+
+// stops the background work of the current router
+func (rr *reloadableRouter) stop() {
+	if current := rr.current.Load(); current != nil {
+		current.cancel()
+	}
+}
+
+func (rr *reloadableRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.current.Load().handler.ServeHTTP(w, r)
+}
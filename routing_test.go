@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grqphical/interchange/config"
+	"github.com/spf13/viper"
+)
+
+func TestGlobalRateLimitReload(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set("developmentMode", false)
+	viper.Set("rateLimit", map[string]any{"requests": 1, "per": "1m"})
+
+	router := &reloadableRouter{logger: &ApplicationLogHandler{}}
+	if err := router.reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.stop)
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/missing", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name      string
+		rateLimit map[string]any
+		wantErr   bool
+		want      int
+	}{
+		// requests that don't match a service are limited too
+		{"first request", nil, false, http.StatusNotFound},
+		{"limited", nil, false, http.StatusTooManyRequests},
+		{"reloading keeps the bucket", map[string]any{"requests": 1, "per": "1m"}, false, http.StatusTooManyRequests},
+		{"invalid limit keeps the previous router", map[string]any{"requests": 0}, true, http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		if tt.rateLimit != nil {
+			viper.Set("rateLimit", tt.rateLimit)
+			if err := router.reload(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("%s: reload error = %v, want error %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if got := serve(); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// returns a route on prefix that answers with its name
+func testRoute(name, prefix string, match *requestMatcher) *serviceRoute {
+	return &serviceRoute{
+		name:   name,
+		prefix: routePrefix(prefix),
+		match:  match,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}),
+	}
+}
+
+func TestHostRouter(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultHost string
+		host        string
+		path        string
+		// the service that should handle the request, or empty if none should
+		want string
+	}{
+		{"exact host", "", "api.example.com", "/v1/users", "api"},
+		{"host is case-insensitive and ignores the port", "", "API.Example.com.:8080", "/v1/users", "api"},
+		{"exact beats wildcard", "", "www.example.com", "/", "www"},
+		{"wildcard", "", "shop.example.com", "/", "subdomains"},
+		{"wildcard matches deeper subdomains", "", "a.b.example.com", "/", "subdomains"},
+		{"longest wildcard wins", "", "eu.cdn.example.com", "/", "cdn"},
+		{"wildcard doesn't match the bare domain", "", "example.com", "/pages/about", "everywhere"},
+		{"wildcard doesn't match the end of another name", "", "badexample.com", "/pages/about", "everywhere"},
+		{"unknown host uses the services on every host", "", "other.org", "/pages/about", "everywhere"},
+		{"unknown host is routed as the default host", "www.example.com", "other.org", "/", "www"},
+		{"services on every host are used when the host has no matching route", "", "api.example.com", "/pages/about", "everywhere"},
+		{"no route", "", "api.example.com", "/missing", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newHostRouter(tt.defaultHost)
+			router.Handle([]string{"api.example.com"}, testRoute("api", "/v1", &requestMatcher{}))
+			router.Handle([]string{"www.example.com"}, testRoute("www", "/", &requestMatcher{}))
+			router.Handle([]string{"*.example.com"}, testRoute("subdomains", "/", &requestMatcher{}))
+			router.Handle([]string{"*.cdn.example.com"}, testRoute("cdn", "/", &requestMatcher{}))
+			router.Handle(nil, testRoute("everywhere", "/pages", &requestMatcher{}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Host = tt.host
+			router.ServeHTTP(w, r)
+
+			if tt.want == "" {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+				}
+				return
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("served by %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceHosts(t *testing.T) {
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"example.com", false},
+		{"*.example.com", false},
+		{"*", false},
+		{"*example.com", true},
+		{"www.*.com", true},
+		{"*.*.example.com", true},
+	}
+
+	for _, tt := range tests {
+		_, err := serviceHosts(map[string]any{"hosts": []any{tt.host}})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.host, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRequestMatcher(t *testing.T) {
+	tests := []struct {
+		name   string
+		match  map[string]any
+		method string
+		target string
+		header http.Header
+		want   bool
+	}{
+		{"no conditions", map[string]any{}, http.MethodDelete, "/", nil, true},
+		{"method", map[string]any{"methods": []any{"get", "POST"}}, http.MethodPost, "/", nil, true},
+		{"other method", map[string]any{"methods": []any{"get", "POST"}}, http.MethodDelete, "/", nil, false},
+		{"header value", map[string]any{"headers": map[string]any{"x-env": "staging"}}, http.MethodGet, "/", http.Header{"X-Env": {"staging"}}, true},
+		{"one of several header values", map[string]any{"headers": map[string]any{"x-env": "staging"}}, http.MethodGet, "/", http.Header{"X-Env": {"prod", "staging"}}, true},
+		{"other header value", map[string]any{"headers": map[string]any{"x-env": "staging"}}, http.MethodGet, "/", http.Header{"X-Env": {"prod"}}, false},
+		{"header present", map[string]any{"headers": map[string]any{"x-env": ""}}, http.MethodGet, "/", http.Header{"X-Env": {"prod"}}, true},
+		{"header missing", map[string]any{"headers": map[string]any{"x-env": ""}}, http.MethodGet, "/", nil, false},
+		{"header pattern", map[string]any{"headerpatterns": map[string]any{"user-agent": "^curl/"}}, http.MethodGet, "/", http.Header{"User-Agent": {"curl/8.0"}}, true},
+		{"header pattern mismatch", map[string]any{"headerpatterns": map[string]any{"user-agent": "^curl/"}}, http.MethodGet, "/", http.Header{"User-Agent": {"Mozilla/5.0"}}, false},
+		{"query value", map[string]any{"query": map[string]any{"version": "2"}}, http.MethodGet, "/?version=2", nil, true},
+		{"query name ignores case", map[string]any{"query": map[string]any{"version": "2"}}, http.MethodGet, "/?Version=2", nil, true},
+		{"one of several query values", map[string]any{"query": map[string]any{"version": "2"}}, http.MethodGet, "/?version=1&version=2", nil, true},
+		{"other query value", map[string]any{"query": map[string]any{"version": "2"}}, http.MethodGet, "/?version=1", nil, false},
+		{"query parameter present", map[string]any{"query": map[string]any{"debug": ""}}, http.MethodGet, "/?debug", nil, true},
+		{"query parameter missing", map[string]any{"query": map[string]any{"debug": ""}}, http.MethodGet, "/", nil, false},
+		{"cookie value", map[string]any{"cookies": map[string]any{"tier": "gold"}}, http.MethodGet, "/", http.Header{"Cookie": {"tier=gold"}}, true},
+		{"other cookie value", map[string]any{"cookies": map[string]any{"tier": "gold"}}, http.MethodGet, "/", http.Header{"Cookie": {"tier=silver"}}, false},
+		{"cookie name ignores case", map[string]any{"cookies": map[string]any{"session": ""}}, http.MethodGet, "/", http.Header{"Cookie": {"Session=abc"}}, true},
+		{"cookie missing", map[string]any{"cookies": map[string]any{"session": ""}}, http.MethodGet, "/", http.Header{"Cookie": {"other=abc"}}, false},
+		{
+			"every condition must match",
+			map[string]any{"methods": []any{"GET"}, "headers": map[string]any{"x-env": "staging"}, "query": map[string]any{"version": "2"}},
+			http.MethodGet, "/?version=1", http.Header{"X-Env": {"staging"}}, false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := buildRequestMatcher(config.NewTable(tt.match))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := m.matches(r); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := buildRequestMatcher(config.NewTable(map[string]any{"headerpatterns": map[string]any{"user-agent": "("}})); err == nil {
+		t.Error("expected an error for an invalid header pattern")
+	}
+}
+
+func TestServiceTable(t *testing.T) {
+	services := map[string]map[string]any{
+		"low":      {"route": "/api/v1", "priority": -1},
+		"boosted":  {"route": "/", "priority": 10, "match": map[string]any{"cookies": map[string]any{"canary": "1"}}},
+		"v1":       {"route": "/api/v1/*"},
+		"api":      {"route": "/api"},
+		"zeta":     {"route": "/api/"},
+		"alpha":    {"route": "/api"},
+		"api-post": {"route": "/api", "match": map[string]any{"methods": []any{"POST", "PUT"}}},
+		"api-beta": {"route": "/api", "match": map[string]any{"headers": map[string]any{"x-beta": ""}, "query": map[string]any{"beta": "1"}}},
+	}
+
+	table := &serviceTable{}
+	for _, name := range []string{"zeta", "low", "api", "api-beta", "boosted", "alpha", "v1", "api-post"} {
+		route, err := buildServiceRoute(services[name], name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.add(route)
+	}
+
+	// priority first, then the longest prefix, then the most match conditions and finally the name
+	order := []string{}
+	for _, route := range table.routes {
+		order = append(order, route.name)
+	}
+	if want := "boosted v1 api-beta api-post alpha api zeta low"; strings.Join(order, " ") != want {
+		t.Errorf("order = %v, want %s", order, want)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		want   string
+	}{
+		{"longer prefix", http.MethodGet, "/api/v1/users", nil, "v1"},
+		{"higher priority", http.MethodGet, "/api/v1/users", http.Header{"Cookie": {"canary=1"}}, "boosted"},
+		{"ties are broken by name", http.MethodGet, "/api/users", nil, "alpha"},
+		{"method condition", http.MethodPut, "/api/users", nil, "api-post"},
+		{"most conditions", http.MethodPost, "/api/users?beta=1", http.Header{"X-Beta": {"yes"}}, "api-beta"},
+		{"conditions only partly met", http.MethodGet, "/api/users?beta=1", nil, "alpha"},
+		{"no route", http.MethodGet, "/other", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+
+			got := ""
+			if route := table.find(r); route != nil {
+				got = route.name
+			}
+			if got != tt.want {
+				t.Errorf("found %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package templates
 import (
 	"html/template"
 	"io"
+	"net/http"
 )
 
 const (
@@ -34,8 +35,14 @@ type errorParams struct {
 	Server string
 }
 
-// writes the error template to the given http.ResponseWriter
+// writes the error template to the given writer. If the writer is an http.ResponseWriter the status code is sent
+// along with the page
 func WriteError(w io.Writer, code int, text string) {
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.WriteHeader(code)
+	}
+
 	params := errorParams{
 		Code:   code,
 		Text:   text,